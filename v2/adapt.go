@@ -0,0 +1,28 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+)
+
+// Adapt turns a handler taking a context and args and returning a reply into
+// a func that can be registered with Server.RegisterFunc, as in
+//
+//	s.RegisterFunc(rpc.Adapt("Service.Method", handler))
+//
+// Generic handlers must be instantiated, e.g. handler[Args, Reply]. The
+// handler gets the request context; a nil reply is encoded as the zero R.
+func Adapt[T, R any](method string, fn func(context.Context, *T) (*R, error)) (string, interface{}) {
+	return method, func(r *http.Request, args *T, reply *R) error {
+		res, err := fn(r.Context(), args)
+		if err == nil && res != nil {
+			*reply = *res
+		}
+		return err
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// BatchCodec is implemented by codecs accepting several calls in a single
+// request, such as JSON-RPC 2.0 batches.
+//
+// The calls are served in order, each as a request of its own, and their
+// responses are written as an array, e.g. [{...},{...}]; calls without a
+// response, such as notifications, are left out. The response is a 204 if
+// no call has one. Each call is served with a copy of the request, sharing
+// the response headers.
+type BatchCodec interface {
+	Codec
+	// NewBatchRequest returns the requests of the calls of a batch, or nil
+	// if the request is not a batch, leaving its body to be read by
+	// NewRequest. An error, e.g. for an empty batch, is written with a 400,
+	// except errors reading the body, to be returned as is, which get a
+	// 413 or a 408 as with NewRequest. Batches of more calls than
+	// MaxBatchSizeFromContext should be rejected.
+	NewBatchRequest(r *http.Request) ([]CodecRequest, error)
+}
+
+// BatchErrorWriter is implemented by batch codecs encoding the errors of
+// NewBatchRequest themselves, e.g. as a JSON-RPC error object; they are
+// written as text otherwise.
+type BatchErrorWriter interface {
+	WriteBatchError(w http.ResponseWriter, status int, err error)
+}
+
+// DefaultMaxBatchSize is the maximum number of calls of a batch of a new
+// server. See Server.SetMaxBatchSize.
+const DefaultMaxBatchSize = 100
+
+// SetMaxBatchSize sets the maximum number of calls of a batch, as the calls
+// are served one after the other. Codecs supporting it, such as the JSON-RPC
+// 2.0 codec, reject larger batches, leading to a 400. Zero means no limit.
+func (s *Server) SetMaxBatchSize(n int) {
+	s.maxBatchSize = n
+}
+
+// SetMaxConcurrentBatches limits the number of batches served at once to n,
+// since each of them may have many calls, apart from the limit set with
+// SetMaxConcurrent. Batches over the limit are rejected with a 503, unless
+// SetQueueBatches is set. Zero, the default, means no limit. It must be
+// called before the server is used.
+func (s *Server) SetMaxConcurrentBatches(n int) {
+	if n > 0 {
+		s.batchConcurrency = make(chan struct{}, n)
+	} else {
+		s.batchConcurrency = nil
+	}
+}
+
+// SetQueueBatches makes the batches over the limit set with
+// SetMaxConcurrentBatches wait for a slot instead of being rejected, until
+// the request is canceled.
+func (s *Server) SetQueueBatches(queue bool) {
+	s.queueBatches = queue
+}
+
+// errTooManyBatches is the error of the batches rejected by the limit set
+// with SetMaxConcurrentBatches.
+var errTooManyBatches = errors.New("rpc: too many concurrent batches")
+
+// acquireBatch takes a slot for a batch, waiting for one if batches are
+// queued. It returns the func releasing the slot, or false if no slot was
+// free.
+func (s *Server) acquireBatch(r *http.Request) (func(), bool) {
+	sem := s.batchConcurrency
+	release := func() { <-sem }
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	default:
+	}
+	if !s.queueBatches {
+		return nil, false
+	}
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	case <-r.Context().Done():
+	}
+	return nil, false
+}
+
+// writeBatchError writes an error of NewBatchRequest with the given status
+// and returns the status code of the response.
+func writeBatchError(w http.ResponseWriter, codec BatchCodec, status int, err error) int {
+	ew, ok := codec.(BatchErrorWriter)
+	if !ok {
+		WriteError(w, status, err.Error())
+		return status
+	}
+	sw := &statusWriter{ResponseWriter: w, status: 200}
+	ew.WriteBatchError(sw, status, err)
+	if sw.written != 0 {
+		status = sw.written
+	}
+	return status
+}
+
+// serveBatch serves the calls of a batch, writing their responses at once.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request, codecReqs []CodecRequest, match codecMatch) {
+	var body bytes.Buffer
+	for _, codecReq := range codecReqs {
+		bw := &batchWriter{header: w.Header()}
+		// Each call gets its own request headers, which hooks and methods
+		// may modify.
+		s.serveRequest(bw, r.Clone(r.Context()), time.Now(), codecReq, match)
+		if response := bytes.TrimSpace(bw.body.Bytes()); len(response) > 0 {
+			if body.Len() == 0 {
+				body.WriteByte('[')
+			} else {
+				body.WriteByte(',')
+			}
+			body.Write(response)
+		}
+	}
+	if body.Len() == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body.WriteByte(']')
+	w.Write(body.Bytes())
+}
+
+// batchWriter keeps the response to a call of a batch. The headers are
+// shared by the calls and the status is ignored.
+type batchWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *batchWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *batchWriter) WriteHeader(int) {}
@@ -0,0 +1,84 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BenchmarkResult holds the results of Server.Benchmark.
+type BenchmarkResult struct {
+	Iterations int           // number of calls made
+	Errors     int           // number of calls that failed
+	Duration   time.Duration // total time taken
+	Throughput float64       // calls per second
+	P50        time.Duration // median latency
+	P90        time.Duration // 90th percentile latency
+	P99        time.Duration // 99th percentile latency
+	Max        time.Duration // maximum latency
+}
+
+// Benchmark calls a method iterations times from concurrency goroutines
+// using Call, and reports the throughput and latencies.
+//
+// The args are shared by all the calls, so the method must not modify them.
+// The calls fail if the args are not of the type taken by the method.
+func (s *Server) Benchmark(method string, args interface{}, concurrency, iterations int) BenchmarkResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var replyType reflect.Type
+	if _, methodSpec, err := s.services.get(method); err == nil {
+		replyType = methodSpec.replyType
+	}
+	latencies := make([]time.Duration, iterations)
+	failed := make([]bool, iterations)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				var reply interface{}
+				if replyType != nil {
+					reply = reflect.New(replyType).Interface()
+				}
+				callStart := time.Now()
+				err := s.Call(context.Background(), method, args, reply)
+				latencies[i], failed[i] = time.Since(callStart), err != nil
+			}
+		}()
+	}
+	for i := 0; i < iterations; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	result := BenchmarkResult{Iterations: iterations, Duration: time.Since(start)}
+	for _, f := range failed {
+		if f {
+			result.Errors++
+		}
+	}
+	if iterations == 0 {
+		return result
+	}
+	result.Throughput = float64(iterations) / result.Duration.Seconds()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		return latencies[(iterations-1)*p/100]
+	}
+	result.P50, result.P90, result.P99 = percentile(50), percentile(90), percentile(99)
+	result.Max = latencies[iterations-1]
+	return result
+}
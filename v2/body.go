@@ -0,0 +1,83 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// maxBufferedBodyBytes is the maximum size of a request body buffered by the
+// server, for body hooks or a codec chain.
+const maxBufferedBodyBytes = 10 << 20
+
+// RegisterBodyHook registers a function called with the request body before
+// it is decoded, e.g. to log it or to check a signature. If it returns an
+// error the request is rejected with a 400 and the error message.
+//
+// When hooks are registered the body is read once and shared by all of them
+// and the codec; see BodyFromContext. Bodies larger than 10MB are rejected
+// with a 413.
+func (s *Server) RegisterBodyHook(f func(r *http.Request, body []byte) error) {
+	s.bodyHooks = append(s.bodyHooks, f)
+}
+
+// BodyFromContext returns the request body if it has been buffered by the
+// server, and false otherwise. The slice must not be modified.
+func BodyFromContext(ctx context.Context) ([]byte, bool) {
+	body, ok := ctx.Value(bodyKey).([]byte)
+	return body, ok
+}
+
+// bufferBody reads the body of the request and returns a copy of the
+// request whose body can be read again, with the body in its context.
+func bufferBody(r *http.Request) (*http.Request, []byte, error) {
+	if body, ok := BodyFromContext(r.Context()); ok {
+		return r, body, nil
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBufferedBodyBytes))
+	if err != nil {
+		return r, nil, err
+	}
+	r = r.WithContext(context.WithValue(r.Context(), bodyKey, body))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return r, body, nil
+}
+
+// runBodyHooks buffers the body and calls the hooks registered with
+// RegisterBodyHook. It returns the request to decode, or the status code and
+// error to reject it with.
+func (s *Server) runBodyHooks(r *http.Request) (*http.Request, int, error) {
+	r, body, err := bufferBody(r)
+	if err != nil {
+		return r, readErrorStatus(r, err), err
+	}
+	for _, hook := range s.bodyHooks {
+		if err := hook(r, body); err != nil {
+			return r, 400, err
+		}
+	}
+	return r, 0, nil
+}
+
+// readErrorStatus returns the status code of the response to a request whose
+// body failed to be read or decoded with err: a 413 if it is over the limit
+// set by SetMaxBodyBytes, a 408 if it timed out, see SetReadTimeout, and
+// otherwise a 400.
+func readErrorStatus(r *http.Request, err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if readTimedOut(r) {
+		return http.StatusRequestTimeout
+	}
+	return 400
+}
@@ -0,0 +1,118 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"container/list"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// methodCache holds the replies of a method set by SetMethodCache, in the
+// order they were cached, which is also the order they expire in.
+type methodCache struct {
+	ttl        time.Duration
+	maxEntries int
+	mutex      sync.Mutex
+	entries    map[string]*list.Element // of *cacheEntry
+	order      *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	reply   reflect.Value
+	expires time.Time
+}
+
+// DefaultMethodCacheEntries is the maximum number of replies kept by the
+// cache of a method of a new server. See Server.SetMethodCacheEntries.
+const DefaultMethodCacheEntries = 1000
+
+func newMethodCache(ttl time.Duration, maxEntries int) *methodCache {
+	return &methodCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// SetMethodCache makes the server cache the replies of the method for ttl,
+// keyed by its args encoded as JSON. Requests with the same args are then
+// served from the cache without calling the method. Errors are not cached,
+// nor are replies of args that can't be encoded or of streaming methods.
+// Once the cache is full, the oldest replies are dropped; see
+// SetMethodCacheEntries.
+//
+// The method uses a dotted notation as in "Service.Method". It should only
+// be set for methods whose reply depends on the args alone. A zero ttl
+// disables the cache.
+func (s *Server) SetMethodCache(method string, ttl time.Duration) {
+	method = s.services.canonical(method)
+	if s.methodCaches == nil {
+		s.methodCaches = make(map[string]*methodCache)
+	}
+	if ttl <= 0 {
+		delete(s.methodCaches, method)
+		return
+	}
+	s.methodCaches[method] = newMethodCache(ttl, s.methodCacheEntries)
+}
+
+// SetMethodCacheEntries sets the maximum number of replies kept by the
+// cache of each method set with SetMethodCache, DefaultMethodCacheEntries by
+// default. Zero means no limit. It must be called before SetMethodCache.
+func (s *Server) SetMethodCacheEntries(n int) {
+	s.methodCacheEntries = n
+}
+
+// methodCacheKey returns the cache key of a call, or false if the args
+// can't be encoded.
+func methodCacheKey(method string, args reflect.Value) (string, bool) {
+	b, err := json.Marshal(args.Interface())
+	if err != nil {
+		return "", false
+	}
+	return method + " " + string(b), true
+}
+
+// get returns the cached reply for key, if any.
+func (c *methodCache) get(key string) (reflect.Value, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return reflect.Value{}, false
+	}
+	return entry.reply, true
+}
+
+// put caches the reply for key, dropping the expired replies and, if the
+// cache is full, the oldest ones.
+func (c *methodCache) put(key string, reply reflect.Value) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for elem := c.order.Front(); elem != nil && now.After(elem.Value.(*cacheEntry).expires); elem = c.order.Front() {
+		c.remove(elem)
+	}
+	for c.maxEntries > 0 && c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	entry := &cacheEntry{key: key, reply: reply, expires: now.Add(c.ttl)}
+	c.entries[key] = c.order.PushBack(entry)
+}
+
+// remove drops an entry of the cache.
+func (c *methodCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,43 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// Call calls a registered method in-process, without going through a codec.
+//
+// The method uses a dotted notation as in "Service.Method". The args and
+// reply must be pointers to the types taken by the method, the reply being
+// a *[]interface{} for methods returning their replies; the method gets
+// a POST request to "/" with the given context. Method retries apply, but
+// streaming methods can't be called.
+func (s *Server) Call(ctx context.Context, method string, args, reply interface{}) error {
+	serviceSpec, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+	if methodSpec.stream {
+		return fmt.Errorf("rpc: can't call streaming method %q", method)
+	}
+	argsValue, replyValue := reflect.ValueOf(args), reflect.ValueOf(reply)
+	if argsValue.Kind() != reflect.Ptr || argsValue.IsNil() || argsValue.Type() != reflect.PointerTo(methodSpec.argsType) {
+		return fmt.Errorf("rpc: args of %q must be of type %s", method, reflect.PointerTo(methodSpec.argsType))
+	}
+	if replyValue.Kind() != reflect.Ptr || replyValue.IsNil() || replyValue.Type() != reflect.PointerTo(methodSpec.replyType) {
+		return fmt.Errorf("rpc: reply of %q must be of type %s", method, reflect.PointerTo(methodSpec.replyType))
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", "/", http.NoBody)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(context.WithValue(r.Context(), methodKey, method))
+	return s.callMethod(r, method, serviceSpec, methodSpec, argsValue, replyValue)
+}
@@ -0,0 +1,114 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+// codecChain is a Codec trying several codecs in order. It is used to serve
+// multiple versions of a serialization scheme under the same content type.
+type codecChain struct {
+	codecs []Codec
+}
+
+// NewRequest returns a CodecRequest backed by the first codec of the chain.
+// The body is buffered so the following codecs can read it again, unless the
+// server already did; bodies larger than maxBufferedBodyBytes are rejected.
+func (c *codecChain) NewRequest(r *http.Request) CodecRequest {
+	r, body, err := bufferBody(r)
+	req := &codecChainRequest{chain: c, r: r, body: body, readErr: err}
+	req.current = req.newRequest(0)
+	return req
+}
+
+// codecChainRequest delegates to the codec of the chain that managed to
+// decode the request, falling back to the next one on failure.
+type codecChainRequest struct {
+	chain   *codecChain
+	r       *http.Request
+	body    []byte
+	readErr error
+	index   int
+	current CodecRequest
+}
+
+// newRequest creates a request for the i-th codec with a fresh copy of the
+// body.
+func (c *codecChainRequest) newRequest(i int) CodecRequest {
+	r := new(http.Request)
+	*r = *c.r
+	r.Body = io.NopCloser(bytes.NewReader(c.body))
+	return c.chain.codecs[i].NewRequest(r)
+}
+
+// next switches to the next codec of the chain, reporting false when there
+// is none left.
+func (c *codecChainRequest) next() bool {
+	if c.index+1 >= len(c.chain.codecs) {
+		return false
+	}
+	c.index++
+	c.current = c.newRequest(c.index)
+	return true
+}
+
+// reset switches back to the first codec of the chain, so errors are
+// reported using the primary serialization scheme.
+func (c *codecChainRequest) reset() {
+	c.index = 0
+	c.current = c.newRequest(0)
+}
+
+// Method returns the method reported by the first codec able to read it.
+func (c *codecChainRequest) Method() (string, error) {
+	if c.readErr != nil {
+		return "", c.readErr
+	}
+	method, err := c.current.Method()
+	for first := err; err != nil; {
+		if !c.next() {
+			c.reset()
+			return "", first
+		}
+		method, err = c.current.Method()
+	}
+	return method, nil
+}
+
+// ReadRequest fills args using the first codec able to decode them. The
+// error of the first codec tried is returned if none succeeds.
+func (c *codecChainRequest) ReadRequest(args interface{}) error {
+	method, _ := c.current.Method()
+	first := c.current.ReadRequest(args)
+	for err := first; err != nil; {
+		if !c.next() {
+			c.reset()
+			return first
+		}
+		if m, errMethod := c.current.Method(); errMethod != nil || m != method {
+			continue
+		}
+		// Discard whatever the failed codec partially decoded.
+		v := reflect.ValueOf(args).Elem()
+		v.Set(reflect.Zero(v.Type()))
+		err = c.current.ReadRequest(args)
+	}
+	return nil
+}
+
+// WriteResponse writes the response using the codec that decoded the request.
+func (c *codecChainRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	c.current.WriteResponse(w, reply)
+}
+
+// WriteError writes the error using the codec that decoded the request.
+func (c *codecChainRequest) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
+	c.current.WriteError(w, status, err, reply)
+}
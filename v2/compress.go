@@ -0,0 +1,127 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// EnableCompression makes the server gzip the responses, errors included,
+// for clients sending "Accept-Encoding: gzip". Responses whose
+// Content-Encoding is already set, e.g. by a codec using
+// CompressionSelector, are left as is.
+func (s *Server) EnableCompression(enabled bool) {
+	s.compression = enabled
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body of a response, unless it has no
+// body or its Content-Encoding was set before it is written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+// decide starts compressing if the response can be compressed.
+func (w *gzipResponseWriter) decide(status int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	h := w.Header()
+	if status == http.StatusNoContent || status == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.decide(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	w.decide(http.StatusOK)
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes the end of the compressed body.
+func (w *gzipResponseWriter) finish() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// isGzipEncoded reports whether the body of the request is gzip-encoded.
+func isGzipEncoded(r *http.Request) bool {
+	enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	return enc == "gzip" || enc == "x-gzip"
+}
+
+// gunzipRequest returns the request with its gzip-encoded body decompressed,
+// and without the Content-Encoding header so codecs see a plain body. An
+// empty body is left empty. It fails if the gzip header is malformed, and
+// later reads fail if the rest of the stream is.
+func gunzipRequest(r *http.Request) (*http.Request, error) {
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.Body.Close()
+		return r, err
+	}
+	r = r.WithContext(r.Context())
+	r.Header = r.Header.Clone()
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	if zr == nil {
+		r.Body.Close()
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		return r, nil
+	}
+	r.Body = &gzipBody{Reader: zr, body: r.Body}
+	return r, nil
+}
+
+// gzipBody decompresses a request body, closing it along with the reader.
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
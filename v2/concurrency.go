@@ -0,0 +1,60 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// SetMaxConcurrent limits the number of requests served at once to n, so
+// that traffic spikes are rejected with a 503 instead of overwhelming the
+// services. Zero, the default, means no limit. It must be called before the
+// server is used.
+func (s *Server) SetMaxConcurrent(n int) {
+	if n > 0 {
+		s.concurrency = make(chan struct{}, n)
+	} else {
+		s.concurrency = nil
+	}
+}
+
+// SetMaxConcurrentWait sets how long a request waits for a slot when the
+// limit set by SetMaxConcurrent is reached, before being rejected. Zero, the
+// default, rejects it right away.
+func (s *Server) SetMaxConcurrentWait(d time.Duration) {
+	s.concurrencyWait = d
+}
+
+// errTooManyRequests is the error of the requests rejected by the limit set
+// with SetMaxConcurrent.
+var errTooManyRequests = errors.New("rpc: too many concurrent requests")
+
+// acquire takes a slot for the request, waiting for one up to the duration
+// set by SetMaxConcurrentWait. It returns the func releasing the slot, or
+// false if no slot was free in time.
+func (s *Server) acquire(r *http.Request) (func(), bool) {
+	sem := s.concurrency
+	release := func() { <-sem }
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	default:
+	}
+	if s.concurrencyWait <= 0 {
+		return nil, false
+	}
+	timer := time.NewTimer(s.concurrencyWait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return nil, false
+}
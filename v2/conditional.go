@@ -0,0 +1,37 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// SetLastModified sets the modification time of the data the reply of the
+// method being served is built from. It is meant to be called by methods
+// with the request context.
+//
+// The server then sends it in the Last-Modified header and answers with a
+// 304 and no body if the request has an If-Modified-Since header at or
+// after it. It has no effect on streaming methods.
+func SetLastModified(ctx context.Context, t time.Time) {
+	if lastModified, ok := ctx.Value(lastModifiedKey).(*time.Time); ok {
+		*lastModified = t
+	}
+}
+
+// checkNotModified sets the Last-Modified header and reports whether the
+// request asks for a response only if modified after lastModified.
+func checkNotModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// The header only has a precision of a second.
+	return !lastModified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,79 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ContentTypeCodec is implemented by codecs choosing the Content-Type of
+// their responses, whatever the content type they are registered for. The
+// server sets it in place of the one written by the codec.
+type ContentTypeCodec interface {
+	Codec
+	// Returns the Content-Type of the responses.
+	ContentType() string
+}
+
+// RegisterCodecWithContentType is like RegisterCodec, responding with the
+// responseType Content-Type to the requests of the matchType one, e.g. to
+// serve "application/json-rpc" requests with "application/json" responses.
+// It overrides the ContentType method of the codec, if any, and the last
+// registration for a matchType wins.
+func (s *Server) RegisterCodecWithContentType(codec Codec, matchType, responseType string) {
+	s.RegisterCodec(codec, matchType)
+	s.setResponseType(matchType, responseType)
+}
+
+// setResponseType sets the Content-Type of the responses to the requests of
+// the given content type, or removes it if responseType is empty.
+func (s *Server) setResponseType(contentType, responseType string) {
+	contentType = strings.ToLower(contentType)
+	if responseType == "" {
+		delete(s.responseTypes, contentType)
+		return
+	}
+	if s.responseTypes == nil {
+		s.responseTypes = make(map[string]string)
+	}
+	s.responseTypes[contentType] = responseType
+}
+
+// codecMatch describes how the codec of a request was chosen.
+type codecMatch struct {
+	contentType  string // content type the codec is registered for
+	responseType string // Content-Type of the response, if not the codec one
+}
+
+// contentTypeWriter replaces the Content-Type set by a codec.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+	wroteHeader bool
+}
+
+func (w *contentTypeWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Content-Type", w.contentType)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *contentTypeWriter) Write(p []byte) (int, error) {
+	// Codecs may write the body without a status.
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *contentTypeWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
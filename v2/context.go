@@ -0,0 +1,93 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"reflect"
+)
+
+// contextKey is the type of the keys of the values stored by the server in
+// the request context.
+type contextKey int
+
+const (
+	correlationIDKey contextKey = iota
+	polymorphicTypesKey
+	bodyKey
+	prettyJSONKey
+	methodKey
+	maxDecodeDepthKey
+	lastModifiedKey
+	strictTrailingDataKey
+	successStatusKey
+	requestInfoKey
+	codecRequestKey
+	responseHeaderKey
+	readDeadlineKey
+	maxBatchSizeKey
+)
+
+// CorrelationIDFromContext returns the correlation id of the request, or an
+// empty string if correlation headers are not enabled. See
+// Server.SetCorrelationHeaders.
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey).(string)
+	return id
+}
+
+// RequestInfoFromContext returns the info of the request being served, the
+// one passed to the interrupt funcs and, once the response is written, to
+// the after func; see Server.RegisterAfterFunc.
+func RequestInfoFromContext(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey).(*RequestInfo)
+	return info, ok
+}
+
+// MethodFromContext returns the method being served, in the dotted notation
+// as in "Service.Method", as requested by the client. It lets a method
+// registered under several service names know which one it was called with.
+func MethodFromContext(ctx context.Context) string {
+	method, _ := ctx.Value(methodKey).(string)
+	return method
+}
+
+// PolymorphicTypesFromContext returns the types registered with
+// Server.RegisterPolymorphicType, keyed by discriminator. It is meant for
+// codecs resolving interface fields of the args; the map must not be
+// modified.
+func PolymorphicTypesFromContext(ctx context.Context) map[string]reflect.Type {
+	types, _ := ctx.Value(polymorphicTypesKey).(map[string]reflect.Type)
+	return types
+}
+
+// PrettyJSONFromContext reports whether JSON responses to the request should
+// be indented. See Server.SetPrettyJSON.
+func PrettyJSONFromContext(ctx context.Context) bool {
+	pretty, _ := ctx.Value(prettyJSONKey).(bool)
+	return pretty
+}
+
+// MaxDecodeDepthFromContext returns the maximum nesting depth of the request
+// body set with Server.SetMaxDecodeDepth, or zero if there is no limit.
+func MaxDecodeDepthFromContext(ctx context.Context) int {
+	depth, _ := ctx.Value(maxDecodeDepthKey).(int)
+	return depth
+}
+
+// MaxBatchSizeFromContext returns the maximum number of calls of a batch set
+// with Server.SetMaxBatchSize, or zero if there is no limit.
+func MaxBatchSizeFromContext(ctx context.Context) int {
+	size, _ := ctx.Value(maxBatchSizeKey).(int)
+	return size
+}
+
+// StrictTrailingDataFromContext reports whether data following the request
+// should be rejected. See Server.SetStrictTrailingData.
+func StrictTrailingDataFromContext(ctx context.Context) bool {
+	strict, _ := ctx.Value(strictTrailingDataKey).(bool)
+	return strict
+}
@@ -0,0 +1,82 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// newCorrelationID returns a random 128-bit id, hex encoded.
+func newCorrelationID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// SetRequestIDHeader enables request ids, read from the given header, e.g.
+// "X-Request-ID", or generated when absent, see SetRequestIDFunc. Request ids
+// are correlation ids read from a single header, see SetCorrelationHeaders:
+// the id is stored in the request context, see CorrelationIDFromContext,
+// echoed back in the header, and set in RequestInfo and InstrumentInfo.
+// An empty header disables request ids.
+func (s *Server) SetRequestIDHeader(header string) {
+	if header == "" {
+		s.SetCorrelationHeaders()
+		return
+	}
+	s.SetCorrelationHeaders(header)
+}
+
+// SetRequestIDFunc sets the func generating the ids of the requests without
+// one, by default a random 128-bit id, hex encoded. A nil func restores the
+// default.
+func (s *Server) SetRequestIDFunc(f func() string) {
+	s.requestIDFunc = f
+}
+
+// correlationID returns the correlation id of the request found in the first
+// of the given headers present, and the header it was found in. The W3C
+// traceparent header contributes its trace id. Missing ids are generated
+// with newID.
+func correlationID(r *http.Request, headers []string, newID func() string) (id, header string) {
+	for _, header := range headers {
+		v := r.Header.Get(header)
+		if v == "" {
+			continue
+		}
+		if strings.EqualFold(header, "traceparent") {
+			// version-traceid-parentid-flags
+			parts := strings.Split(v, "-")
+			if len(parts) != 4 || len(parts[1]) != 32 {
+				continue
+			}
+			v = parts[1]
+		}
+		return v, header
+	}
+	return newID(), headers[0]
+}
+
+// withCorrelationID stores the correlation id of the request in its context
+// and echoes it back in the response headers.
+func (s *Server) withCorrelationID(w http.ResponseWriter, r *http.Request) *http.Request {
+	newID := s.requestIDFunc
+	if newID == nil {
+		newID = newCorrelationID
+	}
+	id, header := correlationID(r, s.correlationHeaders, newID)
+	if strings.EqualFold(header, "traceparent") {
+		// The traceparent is echoed unchanged, the id is only its trace id.
+		w.Header().Set(header, r.Header.Get(header))
+	} else {
+		w.Header().Set(header, id)
+	}
+	return r.WithContext(context.WithValue(r.Context(), correlationIDKey, id))
+}
@@ -0,0 +1,41 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deprecation describes a method deprecated with DeprecateMethod.
+type deprecation struct {
+	message string
+	sunset  time.Time
+}
+
+// DeprecateMethod marks a method as deprecated. Its responses then get a
+// "Deprecation: true" header, the message, if any, in a Warning header, and
+// the sunset date, if not zero, in a Sunset header as defined by RFC 8594.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) DeprecateMethod(method, message string, sunset time.Time) {
+	if s.deprecations == nil {
+		s.deprecations = make(map[string]deprecation)
+	}
+	s.deprecations[s.services.canonical(method)] = deprecation{message: message, sunset: sunset}
+}
+
+// setHeaders sets the headers of a deprecated method.
+func (d deprecation) setHeaders(h http.Header) {
+	h.Set("Deprecation", "true")
+	if d.message != "" {
+		h.Set("Warning", "299 - "+strconv.Quote(d.message))
+	}
+	if !d.sunset.IsZero() {
+		h.Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryableError is implemented by errors telling the client whether the
+// call may succeed if retried. Codecs may report it in the error body.
+type RetryableError interface {
+	error
+	Retryable() bool
+}
+
+// RetryAfterError is implemented by errors telling the client how long to
+// wait before retrying. The server sends it in the Retry-After header.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// IsRetryable reports whether err, or an error it wraps, implements
+// RetryableError, and if so whether it is retryable.
+func IsRetryable(err error) (retryable, ok bool) {
+	var re RetryableError
+	if errors.As(err, &re) {
+		return re.Retryable(), true
+	}
+	return false, false
+}
+
+// setRetryAfter sets the Retry-After header if err implements
+// RetryAfterError, rounding up to the second.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var re RetryAfterError
+	if !errors.As(err, &re) {
+		return
+	}
+	if d := re.RetryAfter(); d > 0 {
+		seconds := (d + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+}
+
+// Error is an error with an application error code, returned by service
+// methods so clients can tell errors apart. The server passes it to the
+// codec as is, with the HTTP status mapped from the code by the func set with
+// SetErrorStatusFunc, and JSON-RPC codecs encode it as an error object.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// SetErrorStatusFunc sets the func mapping the code of an *Error returned by
+// a method to the HTTP status of the response. A nil func restores the
+// default, DefaultErrorStatus.
+func (s *Server) SetErrorStatusFunc(f func(code int) int) {
+	s.errorStatus = f
+}
+
+// DefaultErrorStatus maps an *Error code to an HTTP status: codes that are
+// HTTP error statuses are used as is, the JSON-RPC "method not found" code
+// gives a 404, its internal and server error codes a 500, and other codes a
+// 400.
+func DefaultErrorStatus(code int) int {
+	switch {
+	case code >= 400 && code < 600:
+		return code
+	case code == -32601:
+		return http.StatusNotFound
+	case code == -32603 || (code >= -32099 && code <= -32000):
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// NewError returns an *Error with the given code and message. Returned by a
+// method, it gets the status mapped from the code by the func set with
+// SetErrorStatusFunc, which by default uses HTTP error statuses as is.
+func NewError(code int, msg string) error {
+	return &Error{Code: code, Message: msg}
+}
+
+// BadRequest returns an error with code 400, for invalid args.
+func BadRequest(msg string) error {
+	return NewError(http.StatusBadRequest, msg)
+}
+
+// NotFound returns an error with code 404, for resources that don't exist.
+func NotFound(msg string) error {
+	return NewError(http.StatusNotFound, msg)
+}
+
+// Unauthorized returns an error with code 401, for callers lacking valid
+// credentials.
+func Unauthorized(msg string) error {
+	return NewError(http.StatusUnauthorized, msg)
+}
+
+// Internal returns an error with code 500, for failures of the server
+// rather than of the call.
+func Internal(msg string) error {
+	return NewError(http.StatusInternalServerError, msg)
+}
@@ -0,0 +1,65 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// methodExamples holds the examples registered for a method.
+type methodExamples struct {
+	req, resp interface{}
+}
+
+// RegisterMethodExamples registers an example request and response of a
+// method, e.g. for contract tests, checking that they match the args and
+// reply types of the method.
+//
+// The method uses a dotted notation as in "Service.Method". Each example is
+// either a value of the type, or a pointer to it, or its JSON encoding as a
+// json.RawMessage, which must decode without unknown fields.
+func (s *Server) RegisterMethodExamples(method string, reqExample, respExample interface{}) error {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+	if err := checkExample(reqExample, methodSpec.argsType); err != nil {
+		return fmt.Errorf("rpc: request example of %q: %v", method, err)
+	}
+	if err := checkExample(respExample, methodSpec.replyType); err != nil {
+		return fmt.Errorf("rpc: response example of %q: %v", method, err)
+	}
+	if s.examples == nil {
+		s.examples = make(map[string]methodExamples)
+	}
+	s.examples[s.services.canonical(method)] = methodExamples{req: reqExample, resp: respExample}
+	return nil
+}
+
+// MethodExamples returns the examples registered for a method with
+// RegisterMethodExamples.
+func (s *Server) MethodExamples(method string) (reqExample, respExample interface{}, ok bool) {
+	examples, ok := s.examples[s.services.canonical(method)]
+	return examples.req, examples.resp, ok
+}
+
+// checkExample checks that an example is of type t, a pointer to it, or
+// JSON decoding into it.
+func checkExample(example interface{}, t reflect.Type) error {
+	if raw, ok := example.(json.RawMessage); ok {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		return dec.Decode(reflect.New(t).Interface())
+	}
+	et := reflect.TypeOf(example)
+	if et != t && et != reflect.PointerTo(t) {
+		return fmt.Errorf("%v is not of type %v", et, t)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+)
+
+// SetArgsFactory makes the server build the args of a registered method
+// with factory instead of reflect.New, so they can have defaults before
+// being decoded, e.g. a page size that clients may omit. The codec only
+// overwrites the fields present in the request.
+//
+// The method uses a dotted notation as in "Service.Method". The factory
+// must return a new pointer to the args of the method on every call; it is
+// called once to check its type. It takes precedence over the allocator
+// set with RegisterServiceWithAllocators, and the args of the method are no
+// longer pooled. A nil factory restores the default.
+func (s *Server) SetArgsFactory(method string, factory func() interface{}) error {
+	return s.services.setFactory(method, factory, false)
+}
+
+// SetReplyFactory is like SetArgsFactory for the reply of a method, which
+// the method then fills. Streaming methods have no reply.
+func (s *Server) SetReplyFactory(method string, factory func() interface{}) error {
+	return s.services.setFactory(method, factory, true)
+}
+
+// setFactory sets the factory of the args, or of the reply, of a method
+// after checking its type.
+func (m *serviceMap) setFactory(method string, factory func() interface{}, reply bool) error {
+	_, spec, err := m.get(method)
+	if err != nil {
+		return err
+	}
+	name, t, slot := "args", spec.argsType, &spec.argsFactory
+	if reply {
+		if spec.stream {
+			return fmt.Errorf("rpc: reply factory for %q: streaming methods have no reply", method)
+		}
+		name, t, slot = "reply", spec.replyType, &spec.replyFactory
+	}
+	if factory != nil {
+		if err := checkFactory(factory, t); err != nil {
+			return fmt.Errorf("rpc: %s factory for %q: %v", name, method, err)
+		}
+	}
+	slot.Store(factory)
+	return nil
+}
+
+// checkFactory checks that a factory returns pointers to t, by calling it
+// once.
+func checkFactory(factory func() interface{}, t reflect.Type) error {
+	v := factory()
+	if v == nil {
+		return errors.New("factory returned nil")
+	}
+	if reflect.TypeOf(v) != reflect.PointerTo(t) {
+		return fmt.Errorf("values must be of type %s, not %T", reflect.PointerTo(t), v)
+	}
+	return nil
+}
+
+// loadFactory returns the factory stored in v, or nil if there is none.
+func loadFactory(v *atomic.Value) func() interface{} {
+	f, _ := v.Load().(func() interface{})
+	return f
+}
+
+// hasFactory reports whether the args or the reply of the method are built
+// by a factory.
+func (m *serviceMethod) hasFactory() bool {
+	return loadFactory(&m.argsFactory) != nil || loadFactory(&m.replyFactory) != nil
+}
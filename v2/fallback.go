@@ -0,0 +1,85 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+)
+
+// SetFallbackHandler sets a handler serving the requests for unknown
+// methods, e.g. to proxy them upstream, in place of the 404. It gets the
+// method requested, and the codec request is available through
+// CodecRequestFromContext to read the args and write the response.
+//
+// The handler is only called for unregistered methods: ill-formed method
+// names and requests failing to decode are still rejected with a 400.
+func (s *Server) SetFallbackHandler(f func(w http.ResponseWriter, r *http.Request, method string)) {
+	s.fallbackHandler = f
+}
+
+// SetNotFoundHandler sets a handler writing the response to the requests
+// for unknown methods in place of the error written by the codec, e.g. to
+// follow an error format shared with other endpoints. It gets the method
+// requested, and the response has a 404 status unless it writes another
+// one. Unlike the fallback handler, which takes precedence when set, it is
+// only meant to format the error.
+func (s *Server) SetNotFoundHandler(f func(w http.ResponseWriter, r *http.Request, method string)) {
+	s.notFoundHandler = f
+}
+
+// CodecRequestFromContext returns the codec request of the request served
+// by the handler set with SetFallbackHandler or SetNotFoundHandler.
+func CodecRequestFromContext(ctx context.Context) (CodecRequest, bool) {
+	codecReq, ok := ctx.Value(codecRequestKey).(CodecRequest)
+	return codecReq, ok
+}
+
+// serveFallback serves a request for an unknown method with the fallback
+// handler, returning the status code of the response.
+func (s *Server) serveFallback(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, method string) int {
+	fw := &fallbackWriter{ResponseWriter: w, status: 200}
+	r = r.WithContext(context.WithValue(r.Context(), codecRequestKey, codecReq))
+	s.fallbackHandler(fw, r, method)
+	return fw.status
+}
+
+// serveNotFound writes the response to a request for an unknown method with
+// the not-found handler, returning the status code of the response.
+func (s *Server) serveNotFound(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, method string) int {
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusNotFound}
+	r = r.WithContext(context.WithValue(r.Context(), codecRequestKey, codecReq))
+	s.notFoundHandler(sw, r, method)
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusNotFound)
+	}
+	return sw.written
+}
+
+// fallbackWriter records the status written by the fallback handler.
+type fallbackWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *fallbackWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *fallbackWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *fallbackWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+)
+
+// SetFlushInterval makes the server flush responses every n bytes written,
+// so clients see large responses arrive and proxies don't time out while
+// they are encoded. It applies to the response writers implementing
+// http.Flusher. Zero, the default, leaves flushing to the response writer.
+func (s *Server) SetFlushInterval(n int) {
+	s.flushInterval = n
+}
+
+// flushWriter flushes the underlying writer every interval bytes.
+type flushWriter struct {
+	http.ResponseWriter
+	flusher  http.Flusher
+	interval int
+	pending  int // bytes written since the last flush
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if n := w.interval - w.pending; len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.pending += n
+		if err != nil {
+			return written, err
+		}
+		if w.pending >= w.interval {
+			w.Flush()
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *flushWriter) Flush() {
+	w.pending = 0
+	w.flusher.Flush()
+}
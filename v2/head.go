@@ -0,0 +1,56 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// SetReadOnlyMethods declares the methods that don't modify any state, and
+// can therefore be served for HEAD requests. The method is called and the
+// response headers, including Content-Type and Content-Length, are sent
+// without the body. Other methods are rejected with a 405 for HEAD.
+//
+// They are also the methods served for GET requests by the codec registered
+// with RegisterQueryCodec.
+//
+// The methods use a dotted notation as in "Service.Method". Calling it
+// without methods disables HEAD requests.
+func (s *Server) SetReadOnlyMethods(methods ...string) {
+	s.readOnlyMethods = nil
+	if len(methods) > 0 {
+		s.readOnlyMethods = make(map[string]bool, len(methods))
+		for _, method := range methods {
+			s.readOnlyMethods[s.services.canonical(method)] = true
+		}
+	}
+}
+
+// headResponseWriter discards the body of a response to a HEAD request,
+// holding the status back until the length of the body is known.
+type headResponseWriter struct {
+	http.ResponseWriter
+	status int
+	length int
+}
+
+func (w *headResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *headResponseWriter) Write(p []byte) (int, error) {
+	w.length += len(p)
+	return len(p), nil
+}
+
+// finish sends the headers of the response.
+func (w *headResponseWriter) finish() {
+	if w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(w.length))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
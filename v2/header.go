@@ -0,0 +1,39 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// ResponseHeader returns the header the method called with ctx can set, e.g.
+// Cache-Control or ETag, merged into the response once it returns, before
+// the codec writes the response or the error. The x-content-type-options
+// header set by the server can't be overridden. It returns an unused header
+// outside of a method call, and has no effect on streaming methods.
+func ResponseHeader(ctx context.Context) http.Header {
+	h, ok := ctx.Value(responseHeaderKey).(*http.Header)
+	if !ok {
+		return make(http.Header)
+	}
+	if *h == nil {
+		*h = make(http.Header)
+	}
+	return *h
+}
+
+// mergeResponseHeader copies the header set by a method to the response.
+func mergeResponseHeader(w http.ResponseWriter, h http.Header) {
+	dst := w.Header()
+	for key, values := range h {
+		if strings.EqualFold(key, "x-content-type-options") {
+			continue
+		}
+		dst[key] = values
+	}
+}
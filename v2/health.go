@@ -0,0 +1,72 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthPath is the path served by the handler returned by HealthHandler.
+const HealthPath = "/healthz"
+
+// readinessCheck is a check added with AddReadinessCheck.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// AddReadinessCheck adds a check run by the handler returned by
+// HealthHandler, which responds with a 503 if it returns an error.
+func (s *Server) AddReadinessCheck(name string, check func() error) {
+	s.readinessChecks = append(s.readinessChecks, readinessCheck{name, check})
+}
+
+// health is the body of the health check responses.
+type health struct {
+	Status   string            `json:"status"`
+	Services int               `json:"services"`
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// HealthHandler returns a handler for load balancer probes, responding to GET
+// requests for HealthPath with a JSON body giving the number of registered
+// services. The response is a 200, or a 503 listing the errors if any of the
+// readiness checks fails. The server is always ready without checks.
+//
+// The handler doesn't go through the codecs; it is meant to be mounted next
+// to the server, as in
+//
+//	mux.Handle(rpc.HealthPath, s.HealthHandler())
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != HealthPath {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			WriteError(w, http.StatusMethodNotAllowed, "rpc: GET method required, received "+r.Method)
+			return
+		}
+		h := health{Status: "ok", Services: len(s.services.all())}
+		for _, c := range s.readinessChecks {
+			if err := c.check(); err != nil {
+				if h.Failures == nil {
+					h.Failures = make(map[string]string)
+				}
+				h.Failures[c.name] = err.Error()
+			}
+		}
+		status := http.StatusOK
+		if h.Failures != nil {
+			h.Status, status = "unavailable", http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(h)
+	})
+}
@@ -0,0 +1,53 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+	"sort"
+)
+
+// MethodInfo describes a registered method, see Server.Methods.
+type MethodInfo struct {
+	Name      string       // dotted name, as in "Service.method"
+	ArgsType  reflect.Type // type the args point to
+	ReplyType reflect.Type // type the reply points to, or of the stream values
+	Stream    bool         // whether the method is a streaming method
+}
+
+// Methods returns the registered methods sorted by name, e.g. to generate
+// clients.
+func (s *Server) Methods() []MethodInfo {
+	var methods []MethodInfo
+	for _, service := range s.services.all() {
+		for name, spec := range service.methods {
+			methods = append(methods, newMethodInfo(service.name+"."+name, spec))
+		}
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	return methods
+}
+
+// MethodInfo returns the description of a registered method, and false if
+// it is not registered.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) MethodInfo(method string) (MethodInfo, bool) {
+	_, spec, err := s.services.get(method)
+	if err != nil {
+		return MethodInfo{}, false
+	}
+	return newMethodInfo(method, spec), true
+}
+
+func newMethodInfo(name string, spec *serviceMethod) MethodInfo {
+	return MethodInfo{
+		Name:      name,
+		ArgsType:  spec.argsType,
+		ReplyType: spec.replyType,
+		Stream:    spec.stream,
+	}
+}
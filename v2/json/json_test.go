@@ -6,13 +6,19 @@
 package json
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/oh-go/rpc/v2"
 )
@@ -50,6 +56,59 @@ func (t *Service1) ResponseJsonError(r *http.Request, req *Service1Request, res
 	return ErrResponseJsonError
 }
 
+func (t *Service1) Count(r *http.Request, req *Service1Request, res chan<- int) error {
+	for i := req.A; i < req.B; i++ {
+		res <- i
+	}
+	if req.A < 0 {
+		return ErrResponseError
+	}
+	return nil
+}
+
+type Shape interface {
+	Area() float64
+}
+
+type Square struct {
+	Side float64
+}
+
+func (s Square) Area() float64 {
+	return s.Side * s.Side
+}
+
+type Rect struct {
+	W, H float64
+}
+
+func (r *Rect) Area() float64 {
+	return r.W * r.H
+}
+
+type AreaRequest struct {
+	Shape  Shape
+	Others []Shape `json:"others"`
+}
+
+type AreaResponse struct {
+	Area float64
+}
+
+type ShapeService struct {
+}
+
+func (t *ShapeService) Area(r *http.Request, req *AreaRequest, res *AreaResponse) error {
+	if req.Shape == nil {
+		return errors.New("no shape")
+	}
+	res.Area = req.Shape.Area()
+	for _, s := range req.Others {
+		res.Area += s.Area()
+	}
+	return nil
+}
+
 func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) error {
 	if !s.HasMethod(method) {
 		t.Fatal("Expected to be registered:", method)
@@ -130,3 +189,324 @@ func TestClientNullResult(t *testing.T) {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 }
+
+func TestStream(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	code, res := executeRaw(t, s, json.RawMessage(`{"method":"Service1.count","params":[{"A":1,"B":4}],"id":5}`))
+	if code != 200 {
+		t.Error("Expected response code to be 200, but got", code)
+	}
+	if want := `{"result":[1,2,3],"error":null,"id":5}`; res.String() != want {
+		t.Errorf("Expected body to be %s, but got %s", want, res)
+	}
+	var result []int
+	if err := DecodeClientResponse(res, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, []int{1, 2, 3}) {
+		t.Errorf("Expected result to be [1 2 3], but got %v", result)
+	}
+
+	// An error after some values is reported in the error member.
+	_, res = executeRaw(t, s, json.RawMessage(`{"method":"Service1.count","params":[{"A":-1,"B":1}],"id":6}`))
+	if err := DecodeClientResponse(res, &result); err == nil || err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrResponseError, err)
+	}
+}
+
+func TestPolymorphicTypes(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(ShapeService), "")
+	s.RegisterPolymorphicType("square", Square{})
+	s.RegisterPolymorphicType("rect", &Rect{})
+
+	var res AreaResponse
+	req := json.RawMessage(`{"method":"ShapeService.area","params":[{"Shape":{"type":"square","Side":3}}],"id":1}`)
+	if _, body := executeRaw(t, s, req); DecodeClientResponse(body, &res) != nil {
+		t.Fatal("Expected the shape to be decoded, but got", body)
+	}
+	if res.Area != 9 {
+		t.Errorf("Expected area to be 9, but got %v", res.Area)
+	}
+	req = json.RawMessage(`{"method":"ShapeService.area","params":[{"Shape":{"type":"rect","W":2,"H":3},"others":[{"type":"square","Side":1},{"type":"rect","W":1,"H":2}]}],"id":1}`)
+	if _, body := executeRaw(t, s, req); DecodeClientResponse(body, &res) != nil {
+		t.Fatal("Expected the shape to be decoded, but got", body)
+	}
+	if res.Area != 9 {
+		t.Errorf("Expected area to be 9, but got %v", res.Area)
+	}
+
+	// Unknown discriminators can't be decoded into the interface.
+	req = json.RawMessage(`{"method":"ShapeService.area","params":[{"Shape":{"type":"circle","R":1}}],"id":1}`)
+	if code, _ := executeRaw(t, s, req); code != 400 {
+		t.Error("Expected response code to be 400, but got", code)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetPrettyJSON(func(r *http.Request) bool {
+		return r.URL.Query().Has("pretty")
+	})
+
+	for url, want := range map[string]string{
+		"http://localhost:8080/":        `{"result":{"Result":8},"error":null,"id":5}`,
+		"http://localhost:8080/?pretty": "{\n  \"result\": {\n    \"Result\": 8\n  },\n  \"error\": null,\n  \"id\": 5\n}",
+	} {
+		body := bytes.NewBufferString(`{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5}`)
+		r, _ := http.NewRequest("POST", url, body)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Body.String() != want {
+			t.Errorf("Expected body to be %s, but got %s", want, w.Body)
+		}
+	}
+}
+
+func TestMaxDecodeDepth(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetMaxDecodeDepth(4)
+
+	// The envelope and the params array take two levels.
+	req := json.RawMessage(`{"method":"Service1.multiply","params":[{"A":4,"B":2,"C":{"open":"[[[{{\\\"["}}],"id":5}`)
+	if code, res := executeRaw(t, s, req); code != 200 {
+		t.Errorf("Expected response code to be 200, but got %d: %s", code, res)
+	}
+	req = json.RawMessage(`{"method":"Service1.multiply","params":[{"A":4,"B":2,"C":[{}]}],"id":5}`)
+	if code, res := executeRaw(t, s, req); code != 400 {
+		t.Errorf("Expected response code to be 400, but got %d: %s", code, res)
+	}
+}
+
+// failingWriter fails all writes.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWriteResponseError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	var infoErr error
+	s.RegisterInstrumentFunc(func(i *rpc.InstrumentInfo) {
+		infoErr = i.Error
+	})
+
+	body := bytes.NewBufferString(`{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5}`)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", body)
+	r.Header.Set("Content-Type", "application/json")
+	s.ServeHTTP(failingWriter{httptest.NewRecorder()}, r)
+	if infoErr == nil || infoErr.Error() != "connection reset" {
+		t.Errorf("Expected the write error to be reported, but got %v", infoErr)
+	}
+}
+
+func TestStrictTrailingData(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	req := json.RawMessage(`{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5} {"id":6}`)
+	if code, res := executeRaw(t, s, req); code != 200 {
+		t.Errorf("Expected response code to be 200, but got %d: %s", code, res)
+	}
+	s.SetStrictTrailingData(true)
+	if code, res := executeRaw(t, s, req); code != 400 {
+		t.Errorf("Expected response code to be 400, but got %d: %s", code, res)
+	}
+	req = json.RawMessage(`{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5}` + "\n")
+	if code, res := executeRaw(t, s, req); code != 200 {
+		t.Errorf("Expected response code to be 200, but got %d: %s", code, res)
+	}
+}
+
+func TestQueryCodec(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterQueryCodec(NewCodec())
+	s.RegisterService(new(Service1), "")
+	s.SetReadOnlyMethods("Service1.multiply")
+
+	get := func(payload string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/?payload="+url.QueryEscape(payload), nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := get(`{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5}`)
+	var res Service1Response
+	if w.Code != 200 {
+		t.Errorf("Expected response code to be 200, but got %d: %s", w.Code, w.Body)
+	} else if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result to be 8, but got %v and %v", res.Result, err)
+	}
+	if w := get(`{"method":"Service1.responseError","params":[{"A":4,"B":2}],"id":5}`); w.Code != 405 {
+		t.Error("Expected response code to be 405, but got", w.Code)
+	}
+	if w := get(`{"method":`); w.Code != 400 {
+		t.Error("Expected response code to be 400, but got", w.Code)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	var recorded []rpc.RecordedRequest
+	s.SetRequestRecorder(func(method string, body []byte, status int) {
+		recorded = append(recorded, rpc.RecordedRequest{Method: method, Body: body, Status: status})
+	})
+
+	code, res := executeRaw(t, s, json.RawMessage(`{"method":"Service1.responseError","params":[{"A":4,"B":2}],"id":5}`))
+	if len(recorded) != 1 {
+		t.Fatalf("Expected 1 recorded request, but got %d", len(recorded))
+	}
+	rec := recorded[0]
+	if rec.Method != "Service1.responseError" || rec.Status != code {
+		t.Errorf("Expected Service1.responseError with status %d to be recorded, but got %s with %d", code, rec.Method, rec.Status)
+	}
+	if status, body := s.Replay(rec); status != code || string(body) != res.String() {
+		t.Errorf("Expected the replay to get %d %s, but got %d %s", code, res, status, body)
+	}
+}
+
+func TestStreamErrorAfterValues(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(`{"method":"Service1.count","params":[{"A":-2,"B":0}],"id":5}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	res := w.Result()
+	if want := `{"result":[-2,-1],"error":"response error","id":5}`; w.Body.String() != want {
+		t.Errorf("Expected body to be %s, but got %s", want, w.Body)
+	}
+	if trailer := res.Trailer.Get(rpc.StreamErrorTrailer); trailer != ErrResponseError.Error() {
+		t.Errorf("Expected the error trailer to be %q, but got %q", ErrResponseError, trailer)
+	}
+
+	// Complete streams have no error trailer.
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(`{"method":"Service1.count","params":[{"A":0,"B":2}],"id":6}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if trailer := w.Result().Trailer.Get(rpc.StreamErrorTrailer); trailer != "" {
+		t.Errorf("Expected no error trailer, but got %q", trailer)
+	}
+}
+
+func TestAllowGET(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetReadOnlyMethods("Service1.multiply")
+
+	get := func(query string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/"+query, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("?method=Service1.multiply&a=2&b=3"); w.Code != 405 {
+		t.Error("Expected response code to be 405, but got", w.Code)
+	}
+	s.AllowGET(true)
+	w := get("?method=Service1.multiply&a=2&b=3")
+	var res Service1Response
+	if w.Code != 200 {
+		t.Errorf("Expected response code to be 200, but got %d: %s", w.Code, w.Body)
+	} else if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 6 {
+		t.Errorf("Expected result to be 6, but got %v and %v", res.Result, err)
+	}
+	if w := get(""); w.Code != 400 {
+		t.Errorf("Expected response code to be 400, but got %d: %s", w.Code, w.Body)
+	}
+	if w := get("?method=Service1.multiply&a=two"); w.Code != 400 {
+		t.Errorf("Expected response code to be 400, but got %d: %s", w.Code, w.Body)
+	}
+	if w := get("?method=Service1.responseError"); w.Code != 405 {
+		t.Error("Expected response code to be 405, but got", w.Code)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetRequestTimeout(10 * time.Millisecond)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		<-r.Context().Done()
+		return r.Context().Err()
+	})
+	var status int
+	s.RegisterInstrumentFunc(func(i *rpc.InstrumentInfo) {
+		status = i.StatusCode
+	})
+
+	code, res := executeRaw(t, s, json.RawMessage(`{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5}`))
+	if code != 504 || status != 504 {
+		t.Errorf("Expected response code to be 504, but got %d (instrumented %d)", code, status)
+	}
+	if msg, ok := field("error", res.Bytes()); !ok || msg != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected the error to be %q, but got %v", context.DeadlineExceeded, msg)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	req := json.RawMessage(`{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5}`)
+	s.SetMaxBodyBytes(int64(len(req) - 1))
+
+	code, res := executeRaw(t, s, req)
+	if code != 413 {
+		t.Errorf("Expected response code to be 413, but got %d: %s", code, res)
+	}
+	if _, ok := field("error", res.Bytes()); !ok {
+		t.Errorf("Expected a JSON error, but got %s", res)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetReadTimeout(50 * time.Millisecond)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// Only half of the body is sent.
+	body := `{"method":"Service1.multiply","params":[{"A":4,"B":2}],"id":5}`
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
+		len(body), body[:len(body)/2])
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 408 {
+		t.Errorf("Expected response code to be 408, but got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// discriminatorField is the member of a JSON object naming its concrete
+// type when decoded into an interface field.
+const discriminatorField = "type"
+
+// polymorphicDecoder decodes JSON into values with interface fields, using
+// the types registered with rpc.Server.RegisterPolymorphicType.
+//
+// encoding/json can't pick a concrete type for an interface field, but it
+// decodes into the value held by a non-nil interface when it is a pointer.
+// So the fields are first filled with pointers to the types named by the
+// discriminators found in the input, then the input is decoded as usual.
+type polymorphicDecoder struct {
+	types map[string]reflect.Type
+	// Interface fields holding a pointer to a registered non-pointer type,
+	// to be replaced by the pointed value once decoded.
+	derefs []reflect.Value
+}
+
+// decode unmarshals data into v.
+func (d *polymorphicDecoder) decode(data []byte, v interface{}) error {
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return err
+	}
+	d.prepare(reflect.ValueOf(v), tree)
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	for _, field := range d.derefs {
+		field.Set(field.Elem().Elem())
+	}
+	return nil
+}
+
+// prepare fills the interface values found in v with pointers to the types
+// named by the corresponding discriminators of tree, the generic decoding
+// of the input.
+func (d *polymorphicDecoder) prepare(v reflect.Value, tree interface{}) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if tree == nil {
+			return
+		}
+		if v.IsNil() {
+			if !v.CanSet() {
+				return
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.prepare(v.Elem(), tree)
+	case reflect.Struct:
+		obj, ok := tree.(map[string]interface{})
+		if !ok {
+			return
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" || field.Anonymous {
+				continue
+			}
+			if member, ok := lookupMember(obj, field); ok {
+				d.prepare(v.Field(i), member)
+			}
+		}
+	case reflect.Slice:
+		arr, ok := tree.([]interface{})
+		if !ok {
+			return
+		}
+		switch v.Type().Elem().Kind() {
+		case reflect.Interface, reflect.Struct, reflect.Ptr, reflect.Slice:
+		default:
+			return
+		}
+		v.Set(reflect.MakeSlice(v.Type(), len(arr), len(arr)))
+		for i := range arr {
+			d.prepare(v.Index(i), arr[i])
+		}
+	case reflect.Array:
+		arr, ok := tree.([]interface{})
+		if !ok {
+			return
+		}
+		for i := 0; i < len(arr) && i < v.Len(); i++ {
+			d.prepare(v.Index(i), arr[i])
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			// Already holding a value, e.g. the args themselves.
+			d.prepare(v.Elem(), tree)
+			return
+		}
+		obj, ok := tree.(map[string]interface{})
+		if !ok {
+			return
+		}
+		discriminator, _ := obj[discriminatorField].(string)
+		typ, ok := d.types[discriminator]
+		if !ok || !typ.AssignableTo(v.Type()) {
+			return
+		}
+		var p reflect.Value
+		if typ.Kind() == reflect.Ptr {
+			p = reflect.New(typ.Elem())
+		} else {
+			// The method set of *T includes the one of T, so the pointer
+			// can be stored in the field while decoding.
+			p = reflect.New(typ)
+			d.derefs = append(d.derefs, v)
+		}
+		d.prepare(p.Elem(), obj)
+		v.Set(p)
+	}
+}
+
+// lookupMember returns the member of obj decoded into field, matching names
+// the way encoding/json does.
+func lookupMember(obj map[string]interface{}, field reflect.StructField) (interface{}, bool) {
+	name := field.Name
+	if tag := field.Tag.Get("json"); tag != "" {
+		if tag == "-" {
+			return nil, false
+		}
+		if i := strings.Index(tag, ","); i != -1 {
+			tag = tag[:i]
+		}
+		if tag != "" {
+			name = tag
+		}
+	}
+	if member, ok := obj[name]; ok {
+		return member, true
+	}
+	for key, member := range obj {
+		if strings.EqualFold(key, name) {
+			return member, true
+		}
+	}
+	return nil, false
+}
@@ -9,7 +9,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"reflect"
 
 	"github.com/oh-go/rpc/v2"
 )
@@ -72,6 +74,31 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 	return newCodecRequest(r)
 }
 
+// NewRequestFromQuery returns a CodecRequest for a GET request, reading the
+// method from the "method" query parameter and the args from the other
+// parameters, as in "?method=Service.Method&a=2&b=3". Values that are valid
+// JSON, such as numbers, are decoded as such, others as strings.
+func (c *Codec) NewRequestFromQuery(r *http.Request) rpc.CodecRequest {
+	query := r.URL.Query()
+	req := &serverRequest{Method: query.Get("method"), Id: &null}
+	if req.Method == "" {
+		return &CodecRequest{request: req, err: errors.New("rpc: method request ill-formed: missing method parameter")}
+	}
+	query.Del("method")
+	args := make(map[string]json.RawMessage, len(query))
+	for name, values := range query {
+		value := []byte(values[0])
+		if !json.Valid(value) {
+			value, _ = json.Marshal(values[0])
+		}
+		args[name] = value
+	}
+	params, err := json.Marshal([1]interface{}{args})
+	req.Params = (*json.RawMessage)(&params)
+	pretty := rpc.PrettyJSONFromContext(r.Context())
+	return &CodecRequest{request: req, err: err, pretty: pretty}
+}
+
 // ----------------------------------------------------------------------------
 // CodecRequest
 // ----------------------------------------------------------------------------
@@ -80,15 +107,60 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 func newCodecRequest(r *http.Request) rpc.CodecRequest {
 	// Decode the request body and check if RPC method is valid.
 	req := new(serverRequest)
-	err := json.NewDecoder(r.Body).Decode(req)
+	var err error
+	if max := rpc.MaxDecodeDepthFromContext(r.Context()); max > 0 {
+		// Trailing data is always rejected here.
+		err = decodeLimited(r.Body, req, max)
+	} else {
+		dec := json.NewDecoder(r.Body)
+		err = dec.Decode(req)
+		if err == nil && rpc.StrictTrailingDataFromContext(r.Context()) {
+			if _, errToken := dec.Token(); errToken != io.EOF {
+				err = errors.New("rpc: unexpected data after the request")
+			}
+		}
+	}
 	r.Body.Close()
-	return &CodecRequest{request: req, err: err}
+	types := rpc.PolymorphicTypesFromContext(r.Context())
+	pretty := rpc.PrettyJSONFromContext(r.Context())
+	return &CodecRequest{request: req, err: err, types: types, pretty: pretty}
+}
+
+// decodeLimited decodes the JSON read from r into v, failing if it is
+// nested deeper than max arrays and objects.
+func decodeLimited(r io.Reader, v interface{}, max int) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	depth, inString, escaped := 0, false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			escaped = c == '\\'
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > max {
+				return fmt.Errorf("rpc: request nested deeper than %d levels", max)
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return json.Unmarshal(data, v)
 }
 
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
-	request *serverRequest
-	err     error
+	request  *serverRequest
+	err      error
+	types    map[string]reflect.Type // polymorphic types of the server
+	streamed bool                    // whether a stream value was written
+	pretty   bool                    // whether to indent the response
 }
 
 // Method returns the RPC method for the current request.
@@ -102,13 +174,22 @@ func (c *CodecRequest) Method() (string, error) {
 }
 
 // ReadRequest fills the request object for the RPC method.
+//
+// Interface fields of the request object are decoded into the types
+// registered with rpc.Server.RegisterPolymorphicType, chosen by the "type"
+// member of the corresponding JSON object.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
 	if c.err == nil {
 		if c.request.Params != nil {
 			// JSON params is array value. RPC params is struct.
 			// Unmarshal into array containing the request struct.
 			params := [1]interface{}{args}
-			c.err = json.Unmarshal(*c.request.Params, &params)
+			if c.types != nil {
+				dec := &polymorphicDecoder{types: c.types}
+				c.err = dec.decode(*c.request.Params, &params)
+			} else {
+				c.err = json.Unmarshal(*c.request.Params, &params)
+			}
 		} else {
 			c.err = errors.New("rpc: method request ill-formed: missing params field")
 		}
@@ -118,38 +199,112 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 
 // WriteResponse encodes the response and writes it to the ResponseWriter.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
-	if c.request.Id != nil {
+	c.WriteResponseChecked(w, reply)
+}
+
+// WriteResponseChecked is like WriteResponse, returning the error encoding or
+// writing the response, if any.
+func (c *CodecRequest) WriteResponseChecked(w http.ResponseWriter, reply interface{}) error {
+	if c.request.Id == nil {
 		// Id is null for notifications and they don't have a response.
-		res := &serverResponse{
-			Result: reply,
-			Error:  &null,
-			Id:     c.request.Id,
-		}
-		c.writeServerResponse(w, 200, res)
+		return nil
+	}
+	res := &serverResponse{
+		Result: reply,
+		Error:  &null,
+		Id:     c.request.Id,
 	}
+	return c.writeServerResponse(w, 200, res)
 }
 
-func (c *CodecRequest) WriteError(w http.ResponseWriter, _ int, err error, reply interface{}) {
+// WriteStreamStart writes the beginning of a response whose result is the
+// array of the values sent by a streaming method.
+func (c *CodecRequest) WriteStreamStart(w http.ResponseWriter) error {
+	if c.request.Id == nil {
+		// Id is null for notifications and they don't have a response.
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err := w.Write([]byte(`{"result":[`))
+	return err
+}
+
+// WriteStreamValue writes a value of the result array.
+func (c *CodecRequest) WriteStreamValue(w http.ResponseWriter, value interface{}) error {
+	if c.request.Id == nil {
+		return nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if c.streamed {
+		b = append([]byte(","), b...)
+	}
+	c.streamed = true
+	_, err = w.Write(b)
+	return err
+}
+
+// WriteStreamEnd closes the result array and writes the error that
+// interrupted the stream, if any.
+func (c *CodecRequest) WriteStreamEnd(w http.ResponseWriter, err error) error {
+	if c.request.Id == nil {
+		return nil
+	}
+	var errValue interface{} = &null
+	if jsonErr, ok := err.(*Error); ok {
+		errValue = jsonErr.Data
+	} else if err != nil {
+		errValue = err.Error()
+	}
+	b, errMarshal := json.Marshal(errValue)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	end := append([]byte(`],"error":`), b...)
+	end = append(end, `,"id":`...)
+	end = append(append(end, *c.request.Id...), '}')
+	_, errWrite := w.Write(end)
+	return errWrite
+}
+
+// WriteError encodes the error and writes it to the ResponseWriter with the
+// given status, or a 400 if it is 0. An *rpc.Error is encoded as an object
+// with its code.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
 	res := &serverResponse{
 		Result: &null,
 		Id:     c.request.Id,
 	}
 	if jsonErr, ok := err.(*Error); ok {
 		res.Error = jsonErr.Data
+	} else if rpcErr, ok := err.(*rpc.Error); ok {
+		res.Error = rpcErr
 	} else {
 		res.Error = err.Error()
 	}
-	c.writeServerResponse(w, 400, res)
+	if status == 0 {
+		status = 400
+	}
+	c.writeServerResponse(w, status, res)
 }
 
-func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, status int, res *serverResponse) {
-	b, err := json.Marshal(res)
+func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, status int, res *serverResponse) error {
+	var b []byte
+	var err error
+	if c.pretty {
+		b, err = json.MarshalIndent(res, "", "  ")
+	} else {
+		b, err = json.Marshal(res)
+	}
 	if err == nil {
-		w.WriteHeader(status)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.Write(b)
+		w.WriteHeader(status)
+		_, err = w.Write(b)
 	} else {
 		// Not sure in which case will this happen. But seems harmless.
 		rpc.WriteError(w, 400, err.Error())
 	}
+	return err
 }
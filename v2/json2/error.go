@@ -32,6 +32,10 @@ type Error struct {
 
 	// A Primitive or Structured value that contains additional information about the error.
 	Data interface{} `json:"data"` /* optional */
+
+	// Whether the call may succeed if retried, when the server knows it.
+	// This is an extension to the specification.
+	Retryable *bool `json:"retryable,omitempty"` /* optional */
 }
 
 func (e *Error) Error() string {
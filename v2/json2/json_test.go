@@ -6,11 +6,18 @@
 package json2
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/oh-go/rpc/v2"
 )
@@ -109,6 +116,31 @@ func (t *Service1) ResponseError(r *http.Request, req *Service1Request, res *Ser
 	return ErrResponseError
 }
 
+// retryError is an error with retry hints.
+type retryError struct {
+	retryable bool
+}
+
+func (e retryError) Error() string {
+	return "retry error"
+}
+
+func (e retryError) Retryable() bool {
+	return e.retryable
+}
+
+func (e retryError) RetryAfter() time.Duration {
+	return 1500 * time.Millisecond
+}
+
+func (t *Service1) RetryError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return retryError{req.A > 0}
+}
+
+func (t *Service1) AppError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return &rpc.Error{Code: req.A, Message: "app error", Data: req.B}
+}
+
 func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) error {
 	if !s.HasMethod(method) {
 		t.Fatal("Expected to be registered:", method)
@@ -199,3 +231,370 @@ func TestDecodeNullResult(t *testing.T) {
 		t.Error("Expected result to be nil, but got:", result)
 	}
 }
+
+func TestRetryableError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, retryable := range []bool{true, false} {
+		req := &Service1Request{-1, 0}
+		if retryable {
+			req.A = 1
+		}
+		buf, _ := EncodeClientRequest("Service1.retryError", req)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if got := w.HeaderMap.Get("Retry-After"); got != "2" {
+			t.Errorf("Expected Retry-After to be 2, but got %q", got)
+		}
+		err := DecodeClientResponse(w.Body, new(Service1Response))
+		jsonErr, ok := err.(*Error)
+		if !ok {
+			t.Fatal("Expected err to be of a *json2.Error type, but got", err)
+		}
+		if jsonErr.Retryable == nil || *jsonErr.Retryable != retryable {
+			t.Errorf("Expected retryable to be %v, but got %v", retryable, jsonErr.Retryable)
+		}
+	}
+}
+
+func TestAppError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	serve := func(code int) (*ResponseRecorder, error) {
+		buf, _ := EncodeClientRequest("Service1.appError", &Service1Request{code, 7})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w, DecodeClientResponse(w.Body, new(Service1Response))
+	}
+	for _, tt := range []struct{ code, status int }{{404, 404}, {-32601, 404}, {-32001, 500}, {12, 400}} {
+		w, err := serve(tt.code)
+		if w.Code != tt.status {
+			t.Errorf("Expected code %d to give status %d, but got %d", tt.code, tt.status, w.Code)
+		}
+		jsonErr, ok := err.(*Error)
+		if !ok {
+			t.Fatal("Expected err to be of a *json2.Error type, but got", err)
+		}
+		if jsonErr.Code != ErrorCode(tt.code) || jsonErr.Message != "app error" || jsonErr.Data != 7.0 {
+			t.Errorf("Expected the error object of code %d, but got %+v", tt.code, jsonErr)
+		}
+	}
+
+	s.SetErrorStatusFunc(func(code int) int { return 409 })
+	if w, _ := serve(404); w.Code != 409 {
+		t.Errorf("Expected the status func to give 409, but got %d", w.Code)
+	}
+}
+
+func TestInterruptError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	serve := func(method string) (*ResponseRecorder, string) {
+		buf, _ := EncodeClientRequest(method, &Service1Request{1, 0})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		// Only the reply of handler errors is expected to differ.
+		var res struct {
+			Version string          `json:"jsonrpc"`
+			Error   json.RawMessage `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		res.Error = bytes.Replace(res.Error, []byte(`"data":{"Result":0}`), []byte(`"data":null`), 1)
+		b, _ := json.Marshal(res)
+		return w, string(b)
+	}
+	_, handlerBody := serve("Service1.retryError")
+
+	s.RegisterInterruptFunc(func(i *rpc.RequestInfo) *rpc.InterruptInfo {
+		return &rpc.InterruptInfo{Error: retryError{true}, StatusCode: 429}
+	})
+	w, interruptBody := serve("Service1.multiply")
+	if got := w.HeaderMap.Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After to be 2, but got %q", got)
+	}
+	if interruptBody != handlerBody {
+		t.Errorf("Expected the interrupt error to be encoded as %s, but got %s", handlerBody, interruptBody)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	serve := func(body string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := serve(`[
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":4,"B":2},"id":1},
+		{"jsonrpc":"2.0","method":"Service1.divide","params":{"A":4,"B":2},"id":2},
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":3,"B":3}},
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":3,"B":5},"id":3}
+	]`)
+	var res []struct {
+		Result *Service1Response `json:"result"`
+		Error  *Error            `json:"error"`
+		Id     int               `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Expected an array of responses, but got %s: %v", w.Body, err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("Expected 3 responses without the notification, but got %s", w.Body)
+	}
+	if res[0].Id != 1 || res[0].Result == nil || res[0].Result.Result != 8 {
+		t.Errorf("Expected the first call to get 8, but got %s", w.Body)
+	}
+	if res[1].Id != 2 || res[1].Error == nil || res[1].Result != nil {
+		t.Errorf("Expected the second call to fail, but got %s", w.Body)
+	}
+	if res[2].Id != 3 || res[2].Result == nil || res[2].Result.Result != 15 {
+		t.Errorf("Expected the last call to get 15, but got %s", w.Body)
+	}
+
+	for _, body := range []string{` []`, `[
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":1,"B":1},"id":1},
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":2,"B":2},"id":2},
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":3,"B":3},"id":3}
+	]`} {
+		s.SetMaxBatchSize(2)
+		w := serve(body)
+		s.SetMaxBatchSize(rpc.DefaultMaxBatchSize)
+		var res struct {
+			Error *Error          `json:"error"`
+			Id    json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Errorf("Expected a single error object for %s, but got %s: %v", body, w.Body, err)
+			continue
+		}
+		if w.Code != 200 || res.Error == nil || res.Error.Code != E_INVALID_REQ || string(res.Id) != "null" {
+			t.Errorf("Expected an invalid request error with a null id for %s, but got %d and %s", body, w.Code, w.Body)
+		}
+	}
+	var single Service1Response
+	if err := DecodeClientResponse(serve(`{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":4,"B":2},"id":1}`).Body, &single); err != nil || single.Result != 8 {
+		t.Errorf("Expected a single call to get 8, but got %v and %v", single.Result, err)
+	}
+
+	// The calls don't see the headers set for one another.
+	var seen []int
+	s.RegisterInterruptFunc(func(i *rpc.RequestInfo) *rpc.InterruptInfo {
+		i.Request.Header.Add("X-Call", i.Method)
+		seen = append(seen, len(i.Request.Header.Values("X-Call")))
+		return nil
+	})
+	serve(`[
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":1,"B":1},"id":1},
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":2,"B":2},"id":2}
+	]`)
+	if !reflect.DeepEqual(seen, []int{1, 1}) {
+		t.Errorf("Expected each call to have its own headers, but got %v", seen)
+	}
+}
+
+func TestSetMaxConcurrentBatches(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetMaxConcurrentBatches(1)
+	started, release := make(chan bool), make(chan bool)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		started <- true
+		<-release
+		res.Result = req.A * req.B
+		return nil
+	})
+	serve := func(body string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	batch := `[{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":4,"B":2},"id":1}]`
+	codes := make(chan int, 2)
+	go func() { codes <- serve(batch).Code }()
+	<-started
+
+	w := serve(batch)
+	var res struct {
+		Error *Error `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); w.Code != 503 || err != nil || res.Error == nil {
+		t.Errorf("Expected a batch over the limit to get a 503 with an error object, but got %d and %s", w.Code, w.Body)
+	}
+	// Single calls are not limited.
+	if w := serve(`{"jsonrpc":"2.0","method":"Service1.responseError","params":{"A":4,"B":2},"id":1}`); w.Code == 503 {
+		t.Errorf("Expected a single call to be served, but got %d", w.Code)
+	}
+
+	// Queued batches wait for the slot.
+	s.SetQueueBatches(true)
+	go func() { codes <- serve(batch).Code }()
+	release <- true
+	<-started
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != 200 {
+			t.Errorf("Expected the batches to get a 200, but got %d", code)
+		}
+	}
+}
+
+func TestNotification(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	var instrumented []*rpc.InstrumentInfo
+	s.RegisterInstrumentFunc(func(i *rpc.InstrumentInfo) {
+		instrumented = append(instrumented, i)
+	})
+
+	serve := func(body string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := serve(`{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":4,"B":2}}`)
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected a 204 without a body, but got %d and %s", w.Code, w.Body)
+	}
+	if len(instrumented) != 1 {
+		t.Fatalf("Expected the notification to be instrumented, but got %v", instrumented)
+	}
+	if reply, ok := instrumented[0].Reply.(reflect.Value); !ok {
+		t.Errorf("Expected the notification to be instrumented with a reply, but got %v", instrumented[0].Reply)
+	} else if res := reply.Interface().(*Service1Response); res.Result != 8 {
+		t.Errorf("Expected the handler to reply 8, but got %d", res.Result)
+	}
+
+	w = serve(`{"jsonrpc":"2.0","method":"Service1.responseError","params":{"A":4,"B":2}}`)
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected a failed notification to get a 204 without a body, but got %d and %s", w.Code, w.Body)
+	}
+	if len(instrumented) != 2 || instrumented[1].Error != ErrResponseError {
+		t.Errorf("Expected the error of the notification to be instrumented, but got %v", instrumented)
+	}
+
+	w = serve(`[
+		{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":3,"B":3}},
+		{"jsonrpc":"2.0","method":"Service1.bogus","params":{"A":3,"B":3}}
+	]`)
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected a batch of notifications to get a 204 without a body, but got %d and %s", w.Code, w.Body)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetRequestTimeout(10 * time.Millisecond)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		<-r.Context().Done()
+		return r.Context().Err()
+	})
+	var status int
+	s.RegisterInstrumentFunc(func(i *rpc.InstrumentInfo) {
+		status = i.StatusCode
+	})
+
+	buf, _ := EncodeClientRequest("Service1.multiply", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 504 || status != 504 {
+		t.Errorf("Expected response code to be 504, but got %d (instrumented %d)", w.Code, status)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err == nil || err.Error() != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected the error to be %q, but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	buf, _ := EncodeClientRequest("Service1.multiply", &Service1Request{4, 2})
+	s.SetMaxBodyBytes(int64(len(buf) - 1))
+
+	for _, body := range [][]byte{buf, append(append([]byte("["), buf...), ']')} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != 413 {
+			t.Errorf("Expected response code to be 413, but got %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+func TestWrittenStatus(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	var status int
+	s.RegisterAfterFunc(func(i *rpc.RequestInfo) {
+		status = i.StatusCode
+	})
+
+	// The codec sends its protocol errors with a 200, which is reported.
+	body := `{"jsonrpc":"1.0","method":"Service1.multiply","params":{"A":1,"B":2},"id":1}`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 200 || status != 200 {
+		t.Errorf("Expected the 200 written to be reported, but got %d (instrumented %d)", w.Code, status)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetReadTimeout(50 * time.Millisecond)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// Only half of the body is sent.
+	body := `{"jsonrpc":"2.0","method":"Service1.multiply","params":{"A":4,"B":2},"id":5}`
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
+		len(body), body[:len(body)/2])
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 408 {
+		t.Errorf("Expected response code to be 408, but got %d", res.StatusCode)
+	}
+}
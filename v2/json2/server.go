@@ -6,7 +6,10 @@
 package json2
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/oh-go/rpc/v2"
@@ -79,6 +82,51 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 	return newCodecRequest(r, c.encSel.Select(r))
 }
 
+// NewBatchRequest returns a CodecRequest for each call of a batch, sent as
+// an array of requests, or nil if the request is not a batch. The responses
+// of batches are not compressed by the encoder.
+func (c *Codec) NewBatchRequest(r *http.Request) ([]rpc.CodecRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		// Read errors are returned as is, so the server can tell a body
+		// over the limit or timed out.
+		return nil, err
+	}
+	if trimmed := bytes.TrimLeft(body, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '[' {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return nil, nil
+	}
+	var calls []json.RawMessage
+	if err := json.Unmarshal(body, &calls); err != nil {
+		return nil, &Error{Code: E_PARSE, Message: err.Error()}
+	}
+	if len(calls) == 0 {
+		return nil, &Error{Code: E_INVALID_REQ, Message: "empty batch"}
+	}
+	if max := rpc.MaxBatchSizeFromContext(r.Context()); max > 0 && len(calls) > max {
+		return nil, &Error{
+			Code:    E_INVALID_REQ,
+			Message: fmt.Sprintf("batch of %d calls, over the limit of %d", len(calls), max),
+		}
+	}
+	reqs := make([]rpc.CodecRequest, len(calls))
+	for i, call := range calls {
+		callReq := new(http.Request)
+		*callReq = *r
+		callReq.Body = io.NopCloser(bytes.NewReader(call))
+		reqs[i] = newCodecRequest(callReq, rpc.DefaultEncoder)
+	}
+	return reqs, nil
+}
+
+// WriteBatchError writes an error of NewBatchRequest as a single JSON-RPC
+// error object with a null id, e.g. for an empty batch.
+func (c *Codec) WriteBatchError(w http.ResponseWriter, status int, err error) {
+	req := &CodecRequest{request: &serverRequest{Id: &null}, encoder: rpc.DefaultEncoder}
+	req.WriteError(w, status, err, nil)
+}
+
 // ----------------------------------------------------------------------------
 // CodecRequest
 // ----------------------------------------------------------------------------
@@ -103,7 +151,8 @@ func newCodecRequest(r *http.Request, encoder rpc.Encoder) rpc.CodecRequest {
 		}
 	}
 	r.Body.Close()
-	return &CodecRequest{request: req, err: err, encoder: encoder}
+	pretty := rpc.PrettyJSONFromContext(r.Context())
+	return &CodecRequest{request: req, err: err, encoder: encoder, pretty: pretty}
 }
 
 // CodecRequest decodes and encodes a single request.
@@ -111,6 +160,7 @@ type CodecRequest struct {
 	request *serverRequest
 	err     error
 	encoder rpc.Encoder
+	pretty  bool // whether to indent the response
 }
 
 // Method returns the RPC method for the current request.
@@ -123,6 +173,12 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// IsNotification reports whether the request is a notification, a valid
+// request without an id, whose response the server discards.
+func (c *CodecRequest) IsNotification() bool {
+	return c.err == nil && c.request.Id == nil
+}
+
 // ReadRequest fills the request object for the RPC method.
 //
 // ReadRequest parses request parameters in two supported forms in
@@ -168,28 +224,61 @@ func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
 	c.writeServerResponse(w, res)
 }
 
+// WriteError encodes the error and writes it to the ResponseWriter with the
+// given status. The *Error of the codec, e.g. for a malformed request, are
+// sent with a 200 if the status is 0 or a 400.
 func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
 	jsonErr, ok := err.(*Error)
-	if !ok {
+	if rpcErr, isRPC := err.(*rpc.Error); isRPC {
+		// Application errors carry their code and HTTP status.
+		jsonErr = &Error{
+			Code:    ErrorCode(rpcErr.Code),
+			Message: rpcErr.Message,
+			Data:    rpcErr.Data,
+		}
+	} else if !ok {
 		jsonErr = &Error{
 			Code:    E_SERVER,
 			Message: err.Error(),
 			Data:    reply,
 		}
 	}
+	if retryable, ok := rpc.IsRetryable(err); ok && jsonErr.Retryable == nil {
+		e := *jsonErr
+		e.Retryable = &retryable
+		jsonErr = &e
+	}
 	res := &serverResponse{
 		Version: Version,
 		Error:   jsonErr,
 		Id:      c.request.Id,
 	}
-	c.writeServerResponse(w, res)
+	// The errors of the protocol keep the 200 of JSON-RPC, unless the
+	// server has a more specific status than a 400 for them.
+	if ok && status == http.StatusBadRequest {
+		status = 0
+	}
+	c.writeServerResponseStatus(w, status, res)
 }
 
 func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverResponse) {
+	c.writeServerResponseStatus(w, 0, res)
+}
+
+// writeServerResponseStatus writes the response with the given status, or
+// the default one if status is 0.
+func (c *CodecRequest) writeServerResponseStatus(w http.ResponseWriter, status int, res *serverResponse) {
 	// Id is null for notifications and they don't have a response.
 	if c.request.Id != nil {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		encoder := json.NewEncoder(c.encoder.Encode(w))
+		ew := c.encoder.Encode(w)
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+		encoder := json.NewEncoder(ew)
+		if c.pretty {
+			encoder.SetIndent("", "  ")
+		}
 		err := encoder.Encode(res)
 
 		// Not sure in which case will this happen. But seems harmless.
@@ -0,0 +1,95 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyReservoirSize is the number of durations kept by method to compute
+// the percentiles, the most recent ones.
+const latencyReservoirSize = 1024
+
+// latencyStats keeps the durations of the latest calls of each method.
+type latencyStats struct {
+	mu        sync.Mutex
+	durations map[string]*latencyReservoir
+}
+
+// latencyReservoir is a ring of the latest durations of a method.
+type latencyReservoir struct {
+	samples []time.Duration
+	next    int // index of the sample replaced next, once full
+}
+
+// EnableLatencyStats starts keeping the durations of the calls of the
+// registered methods, as seen by the instrument funcs, to report their
+// percentiles with LatencyStats. Only the latest calls of each method are
+// kept. It must be called before serving requests.
+func (s *Server) EnableLatencyStats() {
+	if s.latency == nil {
+		s.latency = &latencyStats{durations: make(map[string]*latencyReservoir)}
+	}
+}
+
+// LatencyStats returns the 50th, 95th and 99th percentiles of the durations
+// of the latest calls of method, or zeros if none was recorded or latency
+// stats are not enabled.
+func (s *Server) LatencyStats(method string) (p50, p95, p99 time.Duration) {
+	if s.latency == nil {
+		return 0, 0, 0
+	}
+	s.latency.mu.Lock()
+	var samples []time.Duration
+	if r := s.latency.durations[method]; r != nil {
+		samples = append(samples, r.samples...)
+	}
+	s.latency.mu.Unlock()
+	if len(samples) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return percentile(samples, 50), percentile(samples, 95), percentile(samples, 99)
+}
+
+// ResetLatencyStats discards the durations recorded so far.
+func (s *Server) ResetLatencyStats() {
+	if s.latency == nil {
+		return
+	}
+	s.latency.mu.Lock()
+	s.latency.durations = make(map[string]*latencyReservoir)
+	s.latency.mu.Unlock()
+}
+
+// observe records the duration of a call of method.
+func (l *latencyStats) observe(method string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.durations[method]
+	if r == nil {
+		r = &latencyReservoir{}
+		l.durations[method] = r
+	}
+	if len(r.samples) < latencyReservoirSize {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % latencyReservoirSize
+}
+
+// percentile returns the p-th percentile of the sorted samples, by the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
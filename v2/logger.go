@@ -0,0 +1,34 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+)
+
+// Logger is implemented by loggers the server reports failing requests to,
+// such as *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// SetLogger sets the logger the server reports failing requests to, whether
+// rejected by the server, e.g. with a 405 or 415, or failed by the method,
+// with the method name if known and the status code. By default nothing is
+// logged; a nil logger restores the default.
+func (s *Server) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// logFailure reports a failing request to the error logger and the logger.
+func (s *Server) logFailure(r *http.Request, method string, status int, err error) {
+	if s.errorLogger != nil {
+		s.errorLogger(r, method, status, err)
+	}
+	if s.logger != nil {
+		s.logger.Printf("rpc: %s %q failed with status %d: %v", r.Method, method, status, err)
+	}
+}
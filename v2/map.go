@@ -6,11 +6,14 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
 )
@@ -19,6 +22,8 @@ var (
 	// Precompute the reflect.Type of error and http.Request
 	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
 	typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfTuple   = reflect.TypeOf([]interface{}(nil))
 )
 
 // ----------------------------------------------------------------------------
@@ -35,25 +40,230 @@ type service struct {
 type serviceMethod struct {
 	method    reflect.Method // receiver method
 	argsType  reflect.Type   // type of the request argument
-	replyType reflect.Type   // type of the response argument
+	replyType reflect.Type   // type of the response argument or stream values
+	stream    bool           // whether replies are sent on a channel
+	tuple     bool           // whether replies are returned, as a []interface{}
+	returned  bool           // whether a single *reply is returned
+	noArgs    bool           // whether the args are an empty struct
+	fn        bool           // whether the method is a func, without receiver
+	ctx       bool           // whether the method takes a context.Context, not the request
+	noRequest bool           // whether the method takes neither the request nor a context
+	impl      atomic.Value   // reflect.Value of the func set by ReplaceMethod
+	values    sync.Pool      // *pooledValues, see Server.EnablePooling
+
+	// allocator returns the args and reply, if set by
+	// RegisterServiceWithAllocators.
+	allocator func() (args, reply interface{})
+
+	// argsFactory and replyFactory hold the func() interface{} building the
+	// args and reply, if set by Server.SetArgsFactory and SetReplyFactory.
+	argsFactory  atomic.Value
+	replyFactory atomic.Value
+}
+
+// newValues returns pointers to new args and reply, from the factories or
+// else the allocator if any. There is no reply for streaming methods.
+func (m *serviceMethod) newValues() (args, reply reflect.Value) {
+	if f := loadFactory(&m.argsFactory); f != nil {
+		args = reflect.ValueOf(f())
+	}
+	if f := loadFactory(&m.replyFactory); f != nil {
+		reply = reflect.ValueOf(f())
+	}
+	if m.allocator != nil && (!args.IsValid() || !reply.IsValid()) {
+		a, r := m.allocator()
+		if a != nil && !args.IsValid() {
+			args = reflect.ValueOf(a)
+		}
+		if r != nil && !reply.IsValid() {
+			reply = reflect.ValueOf(r)
+		}
+	}
+	if !args.IsValid() {
+		args = reflect.New(m.argsType)
+	}
+	if !reply.IsValid() && !m.stream {
+		reply = reflect.New(m.replyType)
+	}
+	return args, reply
+}
+
+// signature returns the type of the method without the receiver.
+func (m *serviceMethod) signature() reflect.Type {
+	mtype := m.method.Type
+	if m.fn {
+		return mtype
+	}
+	in := make([]reflect.Type, mtype.NumIn()-1)
+	for i := range in {
+		in[i] = mtype.In(i + 1)
+	}
+	out := make([]reflect.Type, mtype.NumOut())
+	for i := range out {
+		out[i] = mtype.Out(i)
+	}
+	return reflect.FuncOf(in, out, false)
+}
+
+// call calls the method, or the func that replaced it, with the request or
+// its context, unless the method takes neither, args and reply or stream
+// channel. The replies returned by tuple methods are stored in reply.
+func (m *serviceMethod) call(rcvr, r, args, reply reflect.Value) error {
+	if m.ctx {
+		r = reflect.ValueOf(r.Interface().(*http.Request).Context())
+	}
+	in := []reflect.Value{rcvr, r, args, reply}
+	if m.tuple || m.returned {
+		in = in[:3]
+	} else if m.noRequest {
+		in = []reflect.Value{rcvr, args, reply}
+	}
+	var out []reflect.Value
+	if fn, ok := m.impl.Load().(reflect.Value); ok {
+		out = fn.Call(in[1:])
+	} else if m.fn {
+		out = m.method.Func.Call(in[1:])
+	} else {
+		out = m.method.Func.Call(in)
+	}
+	last := len(out) - 1
+	if m.tuple {
+		values := make([]interface{}, last)
+		for i := range values {
+			values[i] = out[i].Interface()
+		}
+		reply.Elem().Set(reflect.ValueOf(values))
+	} else if m.returned && !out[0].IsNil() {
+		reply.Elem().Set(out[0].Elem())
+	}
+	err, _ := out[last].Interface().(error)
+	return err
 }
 
 // ----------------------------------------------------------------------------
 // serviceMap
 // ----------------------------------------------------------------------------
 
+var (
+	// ErrServiceNotFound is matched by the errors returned for methods of
+	// services that are not registered.
+	ErrServiceNotFound = errors.New("rpc: service not found")
+	// ErrMethodNotFound is matched by the errors returned for methods not
+	// registered on an existing service.
+	ErrMethodNotFound = errors.New("rpc: method not found")
+)
+
+// notFoundError is returned by serviceMap.get for unknown methods. It
+// matches ErrServiceNotFound or ErrMethodNotFound with errors.Is.
+type notFoundError struct {
+	kind error
+	msg  string
+}
+
+func (e *notFoundError) Error() string {
+	return e.msg
+}
+
+func (e *notFoundError) Unwrap() error {
+	return e.kind
+}
+
 // serviceMap is a registry for services.
+//
+// Services are held by a single shard unless split across several shards by
+// setShards, to reduce lock contention with many services.
 type serviceMap struct {
-	mutex    sync.Mutex
+	serviceShard
+	shards []*serviceShard
+
+	// methodName transforms the method names at registration and lookup,
+	// if set by SetMethodNameFunc. By default only the names registered
+	// get their first letter lower-cased.
+	methodName func(service, method string) string
+
+	// allowOverwrite makes the methods of a service whose names collide
+	// once transformed replace each other, if set by
+	// Server.SetAllowOverwrite, instead of failing the registration.
+	allowOverwrite bool
+
+	// lowerNames maps the lower-cased dotted names of the methods to their
+	// registered names, if lookups ignore case.
+	caseInsensitive bool
+	namesMutex      sync.Mutex
+	lowerNames      map[string]string
+}
+
+// serviceShard holds the services of a serviceMap whose names hash to it.
+type serviceShard struct {
+	mutex    sync.RWMutex
 	services map[string]*service
 }
 
+// shard returns the shard of the service with the given name.
+func (m *serviceMap) shard(name string) *serviceShard {
+	if len(m.shards) == 0 {
+		return &m.serviceShard
+	}
+	// FNV-1a, inlined to avoid allocations.
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h = (h ^ uint32(name[i])) * 16777619
+	}
+	return m.shards[h%uint32(len(m.shards))]
+}
+
+// setShards splits the services across n shards, moving those already
+// registered. It must not be called concurrently with other methods.
+func (m *serviceMap) setShards(n int) {
+	services := m.all()
+	m.serviceShard.services, m.shards = nil, nil
+	if n > 1 {
+		m.shards = make([]*serviceShard, n)
+		for i := range m.shards {
+			m.shards[i] = new(serviceShard)
+		}
+	}
+	for _, s := range services {
+		shard := m.shard(s.name)
+		if shard.services == nil {
+			shard.services = make(map[string]*service)
+		}
+		shard.services[s.name] = s
+	}
+}
+
+// all returns the registered services.
+func (m *serviceMap) all() []*service {
+	shards := m.shards
+	if len(shards) == 0 {
+		shards = []*serviceShard{&m.serviceShard}
+	}
+	var services []*service
+	for _, shard := range shards {
+		shard.mutex.RLock()
+		for _, s := range shard.services {
+			services = append(services, s)
+		}
+		shard.mutex.RUnlock()
+	}
+	return services
+}
+
 func lowerFirst(name string) string {
 	return strings.ToLower(name[0:1]) + name[1:]
 }
 
-// register adds a new service using reflection to extract its methods.
-func (m *serviceMap) register(rcvr interface{}, name string) error {
+// methodKey returns the name a method of a service is registered under.
+func (m *serviceMap) methodKey(service, method string) string {
+	if m.methodName != nil {
+		return m.methodName(service, method)
+	}
+	return lowerFirst(method)
+}
+
+// register adds a new service using reflection to extract its methods, with
+// the allocators of its methods keyed by method name.
+func (m *serviceMap) register(rcvr interface{}, name string, allocators map[string]func() (args, reply interface{}), include func(methodName string) bool) error {
 	// Setup service.
 	s := &service{
 		name:     name,
@@ -74,83 +284,399 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 	// Setup methods.
 	for i := 0; i < s.rcvrType.NumMethod(); i++ {
 		method := s.rcvrType.Method(i)
-		mtype := method.Type
 		// Method must be exported.
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs four ins: receiver, *http.Request, *args, *reply.
-		if mtype.NumIn() != 4 {
-			continue
-		}
-		// First argument must be a pointer and must be http.Request.
-		reqType := mtype.In(1)
-		if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
-			continue
-		}
-		// Second argument must be a pointer and must be exported.
-		args := mtype.In(2)
-		if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
+		if include != nil && !include(method.Name) {
 			continue
 		}
-		// Third argument must be a pointer and must be exported.
-		reply := mtype.In(3)
-		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
-			continue
-		}
-		// Method needs one out: error.
-		if mtype.NumOut() != 1 {
-			continue
-		}
-		if returnType := mtype.Out(0); returnType != typeOfError {
-			continue
-		}
-		s.methods[lowerFirst(method.Name)] = &serviceMethod{
-			method:    method,
-			argsType:  args.Elem(),
-			replyType: reply.Elem(),
+		if spec := newServiceMethod(method, 1); spec != nil {
+			key := m.methodKey(s.name, method.Name)
+			if other, ok := s.methods[key]; ok && !m.allowOverwrite {
+				return fmt.Errorf("rpc: methods %s and %s of %q are both named %q",
+					other.method.Name, method.Name, s.name, key)
+			}
+			s.methods[key] = spec
 		}
 	}
 	if len(s.methods) == 0 {
 		return fmt.Errorf("rpc: %q has no exported methods of suitable type",
 			s.name)
 	}
+	for methodName, allocator := range allocators {
+		spec := s.methods[m.methodKey(s.name, methodName)]
+		if spec == nil {
+			return fmt.Errorf("rpc: allocator for unknown method %q", methodName)
+		}
+		if err := checkAllocator(spec, allocator); err != nil {
+			return fmt.Errorf("rpc: allocator for %q: %v", methodName, err)
+		}
+		spec.allocator = allocator
+	}
 	// Add to the map.
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if m.services == nil {
-		m.services = make(map[string]*service)
-	} else if _, ok := m.services[s.name]; ok {
+	shard := m.shard(s.name)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if shard.services == nil {
+		shard.services = make(map[string]*service)
+	} else if _, ok := shard.services[s.name]; ok {
 		return fmt.Errorf("rpc: service already defined: %q", s.name)
 	}
-	m.services[s.name] = s
+	if err := m.indexNames(s.name, s.methods); err != nil {
+		return err
+	}
+	shard.services[s.name] = s
+	return nil
+}
+
+// unregister removes a service.
+func (m *serviceMap) unregister(name string) error {
+	shard := m.shard(name)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	s, ok := shard.services[name]
+	if !ok {
+		return &notFoundError{ErrServiceNotFound, fmt.Sprintf("rpc: can't find service %q", name)}
+	}
+	m.unindexNames(s.name, s.methods)
+	delete(shard.services, name)
+	return nil
+}
+
+// setCaseInsensitive enables or disables lookups ignoring case, indexing
+// the methods already registered. Methods colliding by case are indexed
+// under the first one found.
+func (m *serviceMap) setCaseInsensitive(enabled bool) {
+	m.caseInsensitive = enabled
+	m.namesMutex.Lock()
+	m.lowerNames = nil
+	if enabled {
+		m.lowerNames = make(map[string]string)
+	}
+	m.namesMutex.Unlock()
+	if enabled {
+		for _, s := range m.all() {
+			for name := range s.methods {
+				m.indexNames(s.name, map[string]*serviceMethod{name: nil})
+			}
+		}
+	}
+}
+
+// indexNames adds methods of a service to the case-insensitive index, if
+// lookups ignore case, failing if one of them collides with another
+// method.
+func (m *serviceMap) indexNames(service string, methods map[string]*serviceMethod) error {
+	m.namesMutex.Lock()
+	defer m.namesMutex.Unlock()
+	if m.lowerNames == nil {
+		return nil
+	}
+	names := make(map[string]string, len(methods))
+	for name := range methods {
+		dotted := service + "." + name
+		lower := strings.ToLower(dotted)
+		other, ok := m.lowerNames[lower]
+		if !ok {
+			other, ok = names[lower]
+		}
+		if ok && other != dotted {
+			return fmt.Errorf("rpc: method %q collides with %q ignoring case", dotted, other)
+		}
+		names[lower] = dotted
+	}
+	for lower, dotted := range names {
+		m.lowerNames[lower] = dotted
+	}
+	return nil
+}
+
+// unindexNames removes the methods of a service from the case-insensitive
+// index.
+func (m *serviceMap) unindexNames(service string, methods map[string]*serviceMethod) {
+	m.namesMutex.Lock()
+	defer m.namesMutex.Unlock()
+	for name := range methods {
+		delete(m.lowerNames, strings.ToLower(service+"."+name))
+	}
+}
+
+// canonical returns the name a requested method is registered under, with
+// its method name transformed by methodName and, if lookups ignore case,
+// the case of the registered name. It is the name the settings of the
+// methods are keyed by.
+func (m *serviceMap) canonical(method string) string {
+	if m.methodName != nil {
+		if service, name, ok := strings.Cut(method, "."); ok && name != "" && !strings.Contains(name, ".") {
+			method = service + "." + m.methodName(service, name)
+		}
+	}
+	if !m.caseInsensitive {
+		return method
+	}
+	m.namesMutex.Lock()
+	defer m.namesMutex.Unlock()
+	if name, ok := m.lowerNames[strings.ToLower(method)]; ok {
+		return name
+	}
+	return method
+}
+
+// registerFunc adds a func as a method, creating its service if needed.
+//
+// The method name uses a dotted notation as in "Service.Method".
+func (m *serviceMap) registerFunc(method string, fn interface{}) error {
+	parts := strings.Split(method, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("rpc: service/method request ill-formed: %q", method)
+	}
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return fmt.Errorf("rpc: %q is not a func", method)
+	}
+	spec := newServiceMethod(reflect.Method{Name: parts[1], Type: v.Type(), Func: v}, 0)
+	if spec == nil {
+		return fmt.Errorf("rpc: %q is not of suitable type", method)
+	}
+	name := m.methodKey(parts[0], parts[1])
+	shard := m.shard(parts[0])
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	// Copy the service rather than modifying it, as methods are looked up
+	// without holding the lock.
+	s := &service{name: parts[0], methods: make(map[string]*serviceMethod)}
+	if old := shard.services[parts[0]]; old != nil {
+		if _, ok := old.methods[name]; ok {
+			return fmt.Errorf("rpc: method already defined: %q", method)
+		}
+		*s = *old
+		s.methods = make(map[string]*serviceMethod, len(old.methods)+1)
+		for k, ms := range old.methods {
+			s.methods[k] = ms
+		}
+	}
+	if err := m.indexNames(s.name, map[string]*serviceMethod{name: spec}); err != nil {
+		return err
+	}
+	s.methods[name] = spec
+	if shard.services == nil {
+		shard.services = make(map[string]*service)
+	}
+	shard.services[s.name] = s
 	return nil
 }
 
+// newServiceMethod returns the spec of a method, or nil if it doesn't have
+// a suitable type. The *http.Request or context.Context is the first in of
+// its type, after the receiver if any.
+func newServiceMethod(method reflect.Method, first int) *serviceMethod {
+	mtype := method.Type
+	fn := first == 0
+	// Method needs three ins: *http.Request, *args, *reply, or two for
+	// methods returning their replies or taking only *args, *reply.
+	if mtype.NumIn()-first != 3 && mtype.NumIn()-first != 2 {
+		return nil
+	}
+	// First argument must be a pointer and must be http.Request, or must be
+	// context.Context, unless the method has the two ins *args, *reply.
+	reqType := mtype.In(first)
+	ctx := reqType == typeOfContext
+	isRequest := reqType.Kind() == reflect.Ptr && reqType.Elem() == typeOfRequest
+	noRequest := !ctx && !isRequest && mtype.NumIn()-first == 2 && mtype.NumOut() == 1
+	if noRequest {
+		// Index the ins as if the request came first.
+		first--
+	} else if !ctx && !isRequest {
+		return nil
+	}
+	// Second argument must be a pointer and must be exported.
+	args := mtype.In(first + 1)
+	if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
+		return nil
+	}
+	tuple, returned, stream := mtype.NumIn()-first == 2, false, false
+	replyType := typeOfTuple
+	if tuple && mtype.NumOut() == 2 {
+		// Methods returning a single reply need two outs: a pointer to
+		// the reply, which must be exported, and error.
+		reply := mtype.Out(0)
+		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
+			return nil
+		}
+		tuple, returned, replyType = false, true, reply.Elem()
+	} else if tuple {
+		// Method needs at least three outs: the replies, which must be
+		// exported, and error.
+		if mtype.NumOut() < 3 || !tupleExported(mtype) {
+			return nil
+		}
+	} else {
+		// Third argument must be a pointer and must be exported, or a
+		// send-only channel of exported values for streaming methods.
+		reply := mtype.In(first + 2)
+		stream = reply.Kind() == reflect.Chan && reply.ChanDir() == reflect.SendDir
+		if (reply.Kind() != reflect.Ptr && !stream) || !isExportedOrBuiltin(reply.Elem()) {
+			return nil
+		}
+		// Method needs one out: error.
+		if mtype.NumOut() != 1 {
+			return nil
+		}
+		replyType = reply.Elem()
+	}
+	if returnType := mtype.Out(mtype.NumOut() - 1); returnType != typeOfError {
+		return nil
+	}
+	return &serviceMethod{
+		method:    method,
+		argsType:  args.Elem(),
+		replyType: replyType,
+		stream:    stream,
+		tuple:     tuple,
+		returned:  returned,
+		noArgs:    args.Elem().Kind() == reflect.Struct && args.Elem().NumField() == 0,
+		fn:        fn,
+		ctx:       ctx,
+		noRequest: noRequest,
+	}
+}
+
 // get returns a registered service given a method name.
 //
 // The method name uses a dotted notation as in "Service.Method".
 func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
+	return m.lookup(m.canonical(method))
+}
+
+// lookup returns a registered service given the canonical name of a method.
+func (m *serviceMap) lookup(method string) (*service, *serviceMethod, error) {
 	parts := strings.Split(method, ".")
 	if len(parts) != 2 {
 		err := fmt.Errorf("rpc: service/method request ill-formed: %q", method)
 		return nil, nil, err
 	}
-	m.mutex.Lock()
-	service := m.services[parts[0]]
-	m.mutex.Unlock()
+	shard := m.shard(parts[0])
+	shard.mutex.RLock()
+	service := shard.services[parts[0]]
+	shard.mutex.RUnlock()
 	if service == nil {
-		err := fmt.Errorf("rpc: can't find service %q", method)
+		err := &notFoundError{ErrServiceNotFound, fmt.Sprintf("rpc: can't find service %q", method) + m.suggestion(method)}
 		return nil, nil, err
 	}
 	serviceMethod := service.methods[parts[1]]
 	if serviceMethod == nil {
-		err := fmt.Errorf("rpc: can't find method %q", method)
+		err := &notFoundError{ErrMethodNotFound, fmt.Sprintf("rpc: unknown method %q on service %q", parts[1], parts[0]) + m.suggestion(method)}
 		return nil, nil, err
 	}
 	return service, serviceMethod, nil
 }
 
+// maxSuggestionDistance is the maximum edit distance between an unknown
+// method and the registered one suggested instead.
+const maxSuggestionDistance = 2
+
+// suggestion returns a suggestion of the registered method closest to an
+// unknown one, if within maxSuggestionDistance edits, for its error.
+func (m *serviceMap) suggestion(method string) string {
+	if len(method) > maxSuggestionNameLength {
+		return ""
+	}
+	best, bestDistance := "", maxSuggestionDistance+1
+	for _, s := range m.all() {
+		for name := range s.methods {
+			candidate := s.name + "." + name
+			d := editDistance(method, candidate)
+			if d < bestDistance || (d == bestDistance && candidate < best) {
+				best, bestDistance = candidate, d
+			}
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("; did you mean %q?", best)
+}
+
+// maxSuggestionNameLength bounds the length of the unknown methods compared
+// with the registered ones, as the comparison is quadratic.
+const maxSuggestionNameLength = 128
+
+// editDistance returns the Levenshtein distance between a and b, in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			d := prev[j-1]
+			if a[i-1] != b[j-1] {
+				d++
+			}
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			cur[j] = d
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// empty reports whether no service has been registered.
+func (m *serviceMap) empty() bool {
+	return len(m.all()) == 0
+}
+
+// replace replaces the implementation of a registered method by fn, which
+// must have the signature of the method, without the receiver.
+func (m *serviceMap) replace(method string, fn interface{}) error {
+	_, methodSpec, err := m.get(method)
+	if err != nil {
+		return err
+	}
+	want := methodSpec.signature()
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() || v.Type() != want {
+		return fmt.Errorf("rpc: replacement for %q must be of type %s", method, want)
+	}
+	methodSpec.impl.Store(v)
+	return nil
+}
+
+// checkAllocator checks that an allocator returns pointers to the args and
+// reply of a method, by calling it once.
+func checkAllocator(spec *serviceMethod, allocator func() (args, reply interface{})) error {
+	if spec.stream {
+		return errors.New("streaming methods have no reply")
+	}
+	args, reply := allocator()
+	if args != nil && reflect.TypeOf(args) != reflect.PointerTo(spec.argsType) {
+		return fmt.Errorf("args must be of type %s", reflect.PointerTo(spec.argsType))
+	}
+	if reply != nil && reflect.TypeOf(reply) != reflect.PointerTo(spec.replyType) {
+		return fmt.Errorf("reply must be of type %s", reflect.PointerTo(spec.replyType))
+	}
+	return nil
+}
+
+// tupleExported reports whether the replies returned by a method, all but
+// its last out, are exported or builtin.
+func tupleExported(mtype reflect.Type) bool {
+	for i := 0; i < mtype.NumOut()-1; i++ {
+		if !isExportedOrBuiltin(mtype.Out(i)) {
+			return false
+		}
+	}
+	return true
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
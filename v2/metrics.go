@@ -0,0 +1,146 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UnknownMethodLabel is the method label of the metrics of the requests for
+// unknown methods, so clients can't create unbounded label values.
+const UnknownMethodLabel = "unknown"
+
+// metricBuckets are the upper bounds, in seconds, of the request duration
+// histogram: the Prometheus default buckets.
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricKey identifies the requests of a method with a status code.
+type metricKey struct {
+	method string
+	status int
+}
+
+// metricSample holds the metrics of the requests with a metricKey.
+type metricSample struct {
+	metricKey
+	count   uint64
+	errors  uint64
+	sum     float64  // seconds
+	buckets []uint64 // cumulative counts, by metricBuckets
+}
+
+// metrics records the request count, error count and duration histogram of
+// the requests, by method and status code.
+type metrics struct {
+	mu      sync.Mutex
+	samples map[metricKey]*metricSample
+}
+
+// EnableMetrics starts recording the metrics of the requests, exposed by
+// MetricsHandler and PrometheusCollector. Requests rejected before their
+// method is read, e.g. with a 415, or while shutting down, are labeled
+// UnknownMethodLabel. It must be called before serving requests.
+func (s *Server) EnableMetrics() {
+	if s.metrics == nil {
+		s.metrics = &metrics{samples: make(map[metricKey]*metricSample)}
+	}
+}
+
+// observe records a request. The method must be UnknownMethodLabel for
+// unregistered methods.
+func (m *metrics) observe(method string, status int, err error, duration time.Duration) {
+	key := metricKey{method, status}
+	seconds := duration.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sample := m.samples[key]
+	if sample == nil {
+		sample = &metricSample{metricKey: key, buckets: make([]uint64, len(metricBuckets))}
+		m.samples[key] = sample
+	}
+	sample.count++
+	if err != nil {
+		sample.errors++
+	}
+	sample.sum += seconds
+	for i, le := range metricBuckets {
+		if seconds <= le {
+			sample.buckets[i]++
+		}
+	}
+}
+
+// snapshot returns a copy of the samples, sorted by method and status, or
+// nil if metrics are not enabled.
+func (m *metrics) snapshot() []metricSample {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	samples := make([]metricSample, 0, len(m.samples))
+	for _, sample := range m.samples {
+		s := *sample
+		s.buckets = append([]uint64(nil), sample.buckets...)
+		samples = append(samples, s)
+	}
+	m.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].method != samples[j].method {
+			return samples[i].method < samples[j].method
+		}
+		return samples[i].status < samples[j].status
+	})
+	return samples
+}
+
+// MetricsHandler returns a handler exposing the metrics of the requests
+// served in the Prometheus text format, to be scraped without depending on
+// the Prometheus client: the rpc_requests_total and rpc_errors_total
+// counters and the rpc_request_duration_seconds histogram, labeled by
+// method and status code. Builds with the "prometheus" tag also provide
+// PrometheusCollector.
+//
+// Metrics are recorded once enabled with EnableMetrics. To bound the number
+// of label values, only registered methods get their own label; others are
+// labeled UnknownMethodLabel.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		samples := s.metrics.snapshot()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintln(w, "# HELP rpc_requests_total Number of RPC requests served.")
+		fmt.Fprintln(w, "# TYPE rpc_requests_total counter")
+		for _, sample := range samples {
+			fmt.Fprintf(w, "rpc_requests_total{%s} %d\n", sample.labels(), sample.count)
+		}
+		fmt.Fprintln(w, "# HELP rpc_errors_total Number of RPC requests failed.")
+		fmt.Fprintln(w, "# TYPE rpc_errors_total counter")
+		for _, sample := range samples {
+			fmt.Fprintf(w, "rpc_errors_total{%s} %d\n", sample.labels(), sample.errors)
+		}
+		fmt.Fprintln(w, "# HELP rpc_request_duration_seconds Duration of the RPC requests.")
+		fmt.Fprintln(w, "# TYPE rpc_request_duration_seconds histogram")
+		for _, sample := range samples {
+			labels := sample.labels()
+			for i, le := range metricBuckets {
+				fmt.Fprintf(w, "rpc_request_duration_seconds_bucket{%s,le=%q} %d\n",
+					labels, strconv.FormatFloat(le, 'g', -1, 64), sample.buckets[i])
+			}
+			fmt.Fprintf(w, "rpc_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, sample.count)
+			fmt.Fprintf(w, "rpc_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(sample.sum, 'g', -1, 64))
+			fmt.Fprintf(w, "rpc_request_duration_seconds_count{%s} %d\n", labels, sample.count)
+		}
+	})
+}
+
+// labels returns the labels of the sample in the Prometheus text format.
+func (s *metricSample) labels() string {
+	return fmt.Sprintf("method=%q,status=\"%d\"", s.method, s.status)
+}
@@ -0,0 +1,49 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// HandlerFunc calls a method, in dotted notation as in "Service.Method",
+// with pointers to its args, as decoded from the request, and to its reply,
+// as encoded in the response.
+type HandlerFunc func(r *http.Request, method string, args, reply interface{}) error
+
+// Wrap adds a middleware around the calls of the methods, e.g. to time
+// them, retry them or change their reply. The first middleware added is the
+// outermost.
+//
+// Middlewares are the innermost hooks: they run after the interrupt funcs
+// and the decoding of the args, under the request timeout and on the worker
+// pool if any, around the retries set by SetMethodRetry. The reply they
+// leave is the one encoded and seen by the instrument funcs, and the error
+// they return is handled as an error of the method. Calls with Call are
+// wrapped too, while cached replies and streaming methods are not.
+//
+// next must be given args and reply of the types it was given; the request
+// may be changed, e.g. to set a value in its context, but not the method.
+func (s *Server) Wrap(middleware func(next HandlerFunc) HandlerFunc) {
+	s.middlewares = append(s.middlewares, middleware)
+}
+
+// callWrapped calls a method through the middlewares added with Wrap.
+func (s *Server) callWrapped(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	h := HandlerFunc(func(r *http.Request, _ string, a, res interface{}) error {
+		if reflect.TypeOf(a) != args.Type() || reflect.TypeOf(res) != reply.Type() {
+			return fmt.Errorf("rpc: middleware of %q gave args %T and reply %T, not %s and %s",
+				method, a, res, args.Type(), reply.Type())
+		}
+		return s.callAttempts(r, method, serviceSpec, methodSpec, reflect.ValueOf(a), reflect.ValueOf(res))
+	})
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return h(r, method, args.Interface(), reply.Interface())
+}
@@ -0,0 +1,64 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012-2013 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpack
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// clientRequest represents a msgpack RPC request sent by a client.
+type clientRequest struct {
+	// A String containing the name of the method to be invoked.
+	Method string `msgpack:"method"`
+	// Object to pass as request parameter to the method.
+	Params [1]interface{} `msgpack:"params"`
+	// The request id. This can be of any type. It is used to match the
+	// response with the request that it is replying to.
+	Id uint64 `msgpack:"id"`
+}
+
+// clientResponse represents a msgpack RPC response returned to a client.
+type clientResponse struct {
+	Result rawMessage  `msgpack:"result"`
+	Error  interface{} `msgpack:"error"`
+	Id     uint64      `msgpack:"id"`
+}
+
+// EncodeClientRequest encodes parameters for a msgpack RPC client request.
+func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	c := &clientRequest{
+		Method: method,
+		Params: [1]interface{}{args},
+		Id:     uint64(rand.Int63()),
+	}
+	return Marshal(c)
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply.
+func DecodeClientResponse(r io.Reader, reply interface{}) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var c clientResponse
+	if err := Unmarshal(body, &c); err != nil {
+		return err
+	}
+	if c.Error != nil {
+		return &Error{Data: c.Error}
+	}
+	if len(c.Result) == 0 || c.Result[0] == 0xc0 {
+		return fmt.Errorf("Unexpected null result")
+	}
+	return Unmarshal(c.Result, reply)
+}
@@ -0,0 +1,411 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// maxDepth bounds the nesting of the values decoded, as does encoding/json.
+const maxDepth = 10000
+
+var errUnexpectedEnd = errors.New("msgpack: unexpected end of data")
+
+// Unmarshal decodes the msgpack data into v, a non-nil pointer, failing if
+// data doesn't hold exactly one value.
+//
+// Maps are decoded into structs matching their keys with the names of the
+// fields as encoded by Marshal, or else ignoring case; unknown keys are
+// ignored. Values decoded into an empty interface are nil, bool, int64 or
+// uint64 for integers above its range, float64, string, []byte,
+// []interface{} or map[string]interface{}.
+func Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(data, v, maxDepth)
+}
+
+// unmarshal is like Unmarshal, failing if arrays and maps are nested deeper
+// than depth levels.
+func unmarshal(data []byte, v interface{}, depth int) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: Unmarshal(non-pointer %T)", v)
+	}
+	d := &decoder{data: data, depth: depth}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("msgpack: unexpected data after the value")
+	}
+	return nil
+}
+
+// decoder decodes the values of its data from pos.
+type decoder struct {
+	data  []byte
+	pos   int
+	depth int // the nesting levels left
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		start := d.pos
+		if _, err := d.decodeAny(); err != nil {
+			return err
+		}
+		v.SetBytes(append([]byte(nil), d.data[start:d.pos]...))
+		return nil
+	}
+	if d.pos >= len(d.data) {
+		return errUnexpectedEnd
+	}
+	c := d.data[d.pos]
+	if c == 0xc0 {
+		d.pos++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+			// Decode into the pointer held, as encoding/json does.
+			return d.decode(v.Elem())
+		}
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: can't decode into %s", v.Type())
+		}
+		x, err := d.decodeAny()
+		if err == nil && x != nil {
+			v.Set(reflect.ValueOf(x))
+		}
+		return err
+	}
+	if n, ok, err := d.readHeader(0x90, 0xdc); ok {
+		if err != nil {
+			return err
+		}
+		return d.decodeArray(v, n)
+	}
+	if n, ok, err := d.readHeader(0x80, 0xde); ok {
+		if err != nil {
+			return err
+		}
+		return d.decodeMap(v, n)
+	}
+	x, err := d.decodeScalar()
+	if err != nil {
+		return err
+	}
+	return assign(v, x)
+}
+
+func (d *decoder) decodeArray(v reflect.Value, n int) error {
+	if d.depth--; d.depth < 0 {
+		return errors.New("msgpack: data nested too deeply")
+	}
+	defer func() { d.depth++ }()
+	switch v.Kind() {
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+	case reflect.Array:
+	default:
+		return fmt.Errorf("msgpack: can't decode an array into %s", v.Type())
+	}
+	for i := 0; i < n; i++ {
+		if i >= v.Len() {
+			if _, err := d.decodeAny(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	for i := n; i < v.Len(); i++ {
+		v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+	}
+	return nil
+}
+
+func (d *decoder) decodeMap(v reflect.Value, n int) error {
+	if d.depth--; d.depth < 0 {
+		return errors.New("msgpack: data nested too deeply")
+	}
+	defer func() { d.depth++ }()
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+		return nil
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		for i := 0; i < n; i++ {
+			key, err := d.decodeScalar()
+			if err != nil {
+				return err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return fmt.Errorf("msgpack: can't decode a %T key into %s", key, v.Type())
+			}
+			f := findField(fields, name)
+			if f == nil {
+				if _, err := d.decodeAny(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.FieldByIndex(f.index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("msgpack: can't decode a map into %s", v.Type())
+}
+
+// findField returns the field with the given name, or else the first one
+// whose name matches ignoring case.
+func findField(fields []field, name string) *field {
+	var folded *field
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if folded == nil && strings.EqualFold(fields[i].name, name) {
+			folded = &fields[i]
+		}
+	}
+	return folded
+}
+
+// decodeAny decodes the next value into the types documented by Unmarshal.
+func (d *decoder) decodeAny() (interface{}, error) {
+	if n, ok, err := d.readHeader(0x90, 0xdc); ok {
+		if err != nil {
+			return nil, err
+		}
+		var a []interface{}
+		err = d.decodeArray(reflect.ValueOf(&a).Elem(), n)
+		return a, err
+	}
+	if n, ok, err := d.readHeader(0x80, 0xde); ok {
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		err = d.decodeMap(reflect.ValueOf(m), n)
+		return m, err
+	}
+	return d.decodeScalar()
+}
+
+// readHeader reads the header of an array or a map, whose fix format starts
+// with fix and the 16 bits one with code16. It reports whether the next
+// value is one, and returns its number of elements. The elements take at
+// least a byte each, so larger numbers than the data left are an error.
+func (d *decoder) readHeader(fix, code16 byte) (int, bool, error) {
+	if d.pos >= len(d.data) {
+		return 0, false, nil
+	}
+	var n uint64
+	var err error
+	switch c := d.data[d.pos]; {
+	case c&0xf0 == fix:
+		d.pos++
+		n = uint64(c & 0x0f)
+	case c == code16:
+		d.pos++
+		n, err = d.readUint(2)
+	case c == code16+1:
+		d.pos++
+		n, err = d.readUint(4)
+	default:
+		return 0, false, nil
+	}
+	if err == nil && n > uint64(len(d.data)-d.pos) {
+		err = errUnexpectedEnd
+	}
+	return int(n), true, err
+}
+
+// decodeScalar decodes the next value, which must not be an array or a map.
+func (d *decoder) decodeScalar() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, errUnexpectedEnd
+	}
+	c := d.data[d.pos]
+	d.pos++
+	switch {
+	case c < 0x80:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.readString(uint64(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(n)
+		return append([]byte(nil), b...), err
+	case 0xca:
+		u, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (c - 0xcc))
+		if u <= math.MaxInt64 {
+			return int64(u), err
+		}
+		return u, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.readUint(size)
+		// Sign-extend from the size read.
+		shift := 64 - 8*uint(size)
+		return int64(u<<shift) >> shift, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(n)
+	case 0xc7, 0xc8, 0xc9, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return nil, errors.New("msgpack: extension types are not supported")
+	}
+	return nil, fmt.Errorf("msgpack: invalid format 0x%02x", c)
+}
+
+func (d *decoder) readString(n uint64) (interface{}, error) {
+	b, err := d.read(n)
+	return string(b), err
+}
+
+// read reads the next n bytes.
+func (d *decoder) read(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errUnexpectedEnd
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// readUint reads a big-endian unsigned integer of size bytes.
+func (d *decoder) readUint(size int) (uint64, error) {
+	b, err := d.read(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// assign sets v to the scalar x, converting it to the type of v.
+func assign(v reflect.Value, x interface{}) error {
+	switch x := x.(type) {
+	case bool:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(x)
+			return nil
+		}
+	case int64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if !v.OverflowInt(x) {
+				v.SetInt(x)
+				return nil
+			}
+			return fmt.Errorf("msgpack: %d overflows %s", x, v.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if x >= 0 {
+				return assign(v, uint64(x))
+			}
+			return fmt.Errorf("msgpack: %d overflows %s", x, v.Type())
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(x))
+			return nil
+		}
+	case uint64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if x <= math.MaxInt64 {
+				return assign(v, int64(x))
+			}
+			return fmt.Errorf("msgpack: %d overflows %s", x, v.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if !v.OverflowUint(x) {
+				v.SetUint(x)
+				return nil
+			}
+			return fmt.Errorf("msgpack: %d overflows %s", x, v.Type())
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(x))
+			return nil
+		}
+	case float64:
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			v.SetFloat(x)
+			return nil
+		}
+	case string:
+		if v.Kind() == reflect.String {
+			v.SetString(x)
+			return nil
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(x))
+			return nil
+		}
+	case []byte:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(x)
+			return nil
+		}
+		if v.Kind() == reflect.String {
+			v.SetString(string(x))
+			return nil
+		}
+	}
+	return fmt.Errorf("msgpack: can't decode %T into %s", x, v.Type())
+}
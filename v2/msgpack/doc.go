@@ -0,0 +1,59 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package msgpack provides a codec for RPC over HTTP services encoded with
+msgpack, a binary format lighter than JSON:
+
+	https://msgpack.org
+
+To register the codec in a RPC server:
+
+	import (
+		"http"
+		"github.com/oh-go/rpc/v2"
+		"github.com/oh-go/rpc/v2/msgpack"
+	)
+
+	func init() {
+		s := rpc.NewServer()
+		s.RegisterCodec(msgpack.NewCodec(), "application/msgpack")
+		// [...]
+		http.Handle("/rpc", s)
+	}
+
+Requests and responses follow the conventions of the JSON-RPC 1.0 codec of
+the json package, as msgpack maps.
+
+Request format is:
+
+	method:
+		The name of the method to be invoked, as a string in dotted notation
+		as in "Service.Method".
+	params:
+		An array with a single object to pass as argument to the method.
+	id:
+		The request id, of any type. It is used to match the response with
+		the request that it is replying to.
+
+Response format is:
+
+	result:
+		The Object that was returned by the invoked method,
+		or nil in case there was an error invoking the method.
+	error:
+		An Error object if there was an error invoking the method,
+		or nil if there was no error.
+	id:
+		The same id as the request it is responding to.
+
+Args and replies are encoded as by Marshal, structs as maps keyed by their
+field names. A body that can't be decoded gets a 400 response.
+
+The codec also writes the responses to requests of other codecs, such as
+the json one, whose Accept header prefers application/msgpack; see
+rpc.ResponseCodec.
+*/
+package msgpack
@@ -0,0 +1,329 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpack
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Marshal returns the msgpack encoding of v.
+//
+// Structs are encoded as maps keyed by the names of their exported fields,
+// or the names in their "msgpack" tags, falling back to the "json" ones. As
+// with encoding/json, a "-" name skips the field, the "omitempty" option
+// skips it if empty, and the fields of embedded structs are promoted. Byte
+// slices are encoded as binary, other slices and arrays as arrays, and maps
+// as maps, sorted by key if the keys are strings.
+func Marshal(v interface{}) ([]byte, error) {
+	e := new(encoder)
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// rawMessage is an encoded msgpack value, kept as is to be decoded later.
+type rawMessage []byte
+
+var rawMessageType = reflect.TypeOf(rawMessage(nil))
+
+// encoder appends the encoding of values to its buffer.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			e.buf = append(e.buf, 0xc0)
+		} else {
+			e.buf = append(e.buf, v.Bytes()...)
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.appendUint(uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.appendUint(math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *encoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.appendUint(uint64(i), 2)
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.appendUint(uint64(i), 4)
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.appendUint(uint64(i), 8)
+	}
+}
+
+func (e *encoder) encodeUint(u uint64) {
+	switch {
+	case u < 0x80:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.appendUint(u, 2)
+	case u <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.appendUint(u, 4)
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.appendUint(u, 8)
+	}
+}
+
+func (e *encoder) encodeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.appendUint(uint64(n), 2)
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.appendUint(uint64(n), 4)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) encodeBytes(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.appendUint(uint64(n), 2)
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.appendUint(uint64(n), 4)
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) encodeArray(v reflect.Value) error {
+	e.appendHeader(v.Len(), 0x90, 0xdc)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeMap(v reflect.Value) error {
+	keys := v.MapKeys()
+	if v.Type().Key().Kind() == reflect.String {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	}
+	e.appendHeader(len(keys), 0x80, 0xde)
+	for _, key := range keys {
+		if err := e.encode(key); err != nil {
+			return err
+		}
+		if err := e.encode(v.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	n := 0
+	for _, f := range fields {
+		if !f.omitEmpty || !isEmptyValue(v.FieldByIndex(f.index)) {
+			n++
+		}
+	}
+	e.appendHeader(n, 0x80, 0xde)
+	for _, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		e.encodeString(f.name)
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendHeader appends the header of an array or a map of n elements, using
+// the fix format up to 15 elements, else the 16 or 32 bits one following
+// code16.
+func (e *encoder) appendHeader(n int, fix, code16 byte) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, code16)
+		e.appendUint(uint64(n), 2)
+	default:
+		e.buf = append(e.buf, code16+1)
+		e.appendUint(uint64(n), 4)
+	}
+}
+
+// appendUint appends the size lower bytes of u, big-endian.
+func (e *encoder) appendUint(u uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		e.buf = append(e.buf, byte(u>>(8*uint(i))))
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field is an encoded field of a struct.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the encoded fields of the struct type t.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t, nil))
+	return f.([]field)
+}
+
+// typeFields returns the encoded fields of the struct type t, whose index
+// is prefixed by index if t is embedded. Fields shadowed by others of the
+// same name, at the same or a shallower depth, are dropped.
+func typeFields(t reflect.Type, index []int) []field {
+	var fields []field
+	var embedded [][]field
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("msgpack")
+		if !ok {
+			tag = sf.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fieldIndex := append(append([]int(nil), index...), i)
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, typeFields(sf.Type, fieldIndex))
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		names[name] = true
+		omitEmpty := false
+		for _, opt := range strings.Split(opts, ",") {
+			omitEmpty = omitEmpty || opt == "omitempty"
+		}
+		fields = append(fields, field{name: name, index: fieldIndex, omitEmpty: omitEmpty})
+	}
+	for _, promoted := range embedded {
+		for _, f := range promoted {
+			if !names[f.name] {
+				names[f.name] = true
+				fields = append(fields, f)
+			}
+		}
+	}
+	return fields
+}
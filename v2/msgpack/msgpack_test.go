@@ -0,0 +1,274 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/oh-go/rpc/v2"
+	"github.com/oh-go/rpc/v2/json"
+)
+
+var ErrResponseError = errors.New("response error")
+
+type Service1Request struct {
+	A int
+	B int
+}
+
+type Service1Response struct {
+	Result int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	return nil
+}
+
+func (t *Service1) ResponseError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return ErrResponseError
+}
+
+func (t *Service1) AppError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return &rpc.Error{Code: 409, Message: "conflict"}
+}
+
+func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) (int, error) {
+	if !s.HasMethod(method) {
+		t.Fatal("Expected to be registered:", method)
+	}
+
+	buf, err := EncodeClientRequest(method, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/msgpack")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Errorf("Content-Type was %q, should be application/msgpack.", ct)
+	}
+
+	return w.Code, DecodeClientResponse(w.Body, res)
+}
+
+func executeRaw(t *testing.T, s *rpc.Server, body []byte) (int, *bytes.Buffer) {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", "application/msgpack")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	return w.Code, w.Body
+}
+
+func TestService(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/msgpack")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if code, err := execute(t, s, "Service1.multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got", err)
+	} else if code != 200 {
+		t.Error("Expected response code to be 200, but got", code)
+	}
+	if res.Result != 8 {
+		t.Error("Expected res.Result to be 8, but got", res.Result)
+	}
+	if code, err := execute(t, s, "Service1.responseError", &Service1Request{4, 2}, &res); err == nil {
+		t.Errorf("Expected to get %q, but got nil", ErrResponseError)
+	} else if err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %q", ErrResponseError, err)
+	} else if code != 400 {
+		t.Error("Expected response code to be 400, but got", code)
+	}
+	code, err := execute(t, s, "Service1.appError", &Service1Request{4, 2}, &res)
+	if code != 409 {
+		t.Error("Expected response code to be 409, but got", code)
+	}
+	want := map[string]interface{}{"code": int64(409), "message": "conflict"}
+	if msgpackErr, ok := err.(*Error); !ok || !reflect.DeepEqual(msgpackErr.Data, want) {
+		t.Errorf("Expected err to be a *msgpack.Error with data %v, but got %#v", want, err)
+	}
+}
+
+func TestInvalidBody(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/msgpack")
+	s.RegisterService(new(Service1), "")
+
+	valid, _ := EncodeClientRequest("Service1.multiply", &Service1Request{4, 2})
+	bodies := map[string][]byte{
+		"empty":     {},
+		"truncated": valid[:len(valid)-3],
+		"invalid":   {0xc1},
+		"trailing":  append(valid[:len(valid):len(valid)], 0x01),
+		"too long":  {0xdd, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, body := range bodies {
+		code, res := executeRaw(t, s, body)
+		if code != 400 {
+			t.Errorf("%s: Expected response code to be 400, but got %d", name, code)
+		}
+		var out serverResponse
+		if err := Unmarshal(res.Bytes(), &out); err != nil {
+			t.Errorf("%s: Expected a msgpack response, but got %v", name, err)
+		} else if msg, ok := out.Error.(string); !ok || msg == "" {
+			t.Errorf("%s: Expected an error message, but got %v", name, out.Error)
+		}
+	}
+}
+
+type embedded struct {
+	Embedded string
+}
+
+type roundTrip struct {
+	embedded
+	Int     int
+	Neg     int64
+	Uint    uint16
+	Float   float64
+	Float32 float32
+	Bool    bool
+	Bytes   []byte
+	Tagged  string `msgpack:"tag"`
+	JSON    string `json:"json"`
+	Omitted string `msgpack:",omitempty"`
+	Skipped string `msgpack:"-"`
+	Slice   []string
+	Array   [2]int
+	Map     map[string]int
+	Ptr     *roundTrip
+	Any     interface{}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	in := roundTrip{
+		embedded: embedded{"e"},
+		Int:      1 << 40,
+		Neg:      -1 << 20,
+		Uint:     math.MaxUint16,
+		Float:    2.5,
+		Float32:  -0.5,
+		Bool:     true,
+		Bytes:    []byte{0, 1, 2},
+		Tagged:   "tagged",
+		JSON:     "json",
+		Skipped:  "skipped",
+		Slice:    []string{"a", string(make([]byte, 40))},
+		Array:    [2]int{-1, 200},
+		Map:      map[string]int{"a": 1, "b": -33},
+		Ptr:      &roundTrip{Int: 7},
+		Any:      []interface{}{int64(1), "x", nil, map[string]interface{}{"k": true}},
+	}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out roundTrip
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := in
+	want.Skipped = ""
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("Round trip gave %+v, should be %+v.", out, want)
+	}
+
+	var fields map[string]interface{}
+	if err := Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Embedded", "tag", "json"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("Field %q is missing from %v.", name, fields)
+		}
+	}
+	for _, name := range []string{"Omitted", "Skipped", "Tagged", "JSON"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("Field %q shouldn't be encoded.", name)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var small struct{ A int8 }
+	b, _ := Marshal(map[string]int{"A": 300})
+	if err := Unmarshal(b, &small); err == nil {
+		t.Error("Expected an overflow error, but got nil")
+	}
+	var s string
+	b, _ = Marshal(1)
+	if err := Unmarshal(b, &s); err == nil {
+		t.Error("Expected a type error, but got nil")
+	}
+	deep := bytes.Repeat([]byte{0x91}, 3)
+	deep = append(deep, 0x01)
+	var v interface{}
+	if err := unmarshal(deep, &v, 2); err == nil {
+		t.Error("Expected a depth error, but got nil")
+	}
+	if err := unmarshal(deep, &v, 3); err != nil {
+		t.Error("Expected err to be nil, but got", err)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json.NewCodec(), "application/json")
+	s.RegisterCodec(NewCodec(), "application/msgpack")
+	s.RegisterService(new(Service1), "")
+
+	serve := func(method, accept string) *httptest.ResponseRecorder {
+		body := `{"method":"` + method + `","params":[{"A":4,"B":2}],"id":1}`
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("Service1.multiply", "application/msgpack, application/json;q=0.5")
+	if ct := w.Header().Get("Content-Type"); w.Code != 200 || ct != "application/msgpack" {
+		t.Fatalf("Expected a 200 in msgpack, but got %d in %q: %s", w.Code, ct, w.Body)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected the result to be 8, but got %d and %v", res.Result, err)
+	}
+
+	w = serve("Service1.appError", "application/msgpack")
+	if w.Code != 409 || w.Header().Get("Content-Type") != "application/msgpack" {
+		t.Errorf("Expected a 409 in msgpack, but got %d in %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if err := DecodeClientResponse(w.Body, &res); err == nil {
+		t.Error("Expected the error to be decoded")
+	}
+
+	// The json codec writes the responses preferred in JSON.
+	w = serve("Service1.multiply", "application/json, application/msgpack;q=0.5")
+	var jsonRes Service1Response
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected a JSON response, but got %q", ct)
+	} else if err := json.DecodeClientResponse(w.Body, &jsonRes); err != nil || jsonRes.Result != 8 {
+		t.Errorf("Expected the result to be 8, but got %d and %v", jsonRes.Result, err)
+	}
+}
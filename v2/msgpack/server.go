@@ -0,0 +1,172 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/oh-go/rpc/v2"
+)
+
+// An Error is a wrapper for a msgpack interface value. It can be used by
+// either a service's handler func to write more complex data to an error
+// field of a server's response, or by a client to read it.
+type Error struct {
+	Data interface{}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v", e.Data)
+}
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// serverRequest represents a msgpack RPC request received by the server.
+type serverRequest struct {
+	// A String containing the name of the method to be invoked.
+	Method string `msgpack:"method"`
+	// An Array of objects to pass as arguments to the method.
+	Params rawMessage `msgpack:"params"`
+	// The request id. This can be of any type. It is used to match the
+	// response with the request that it is replying to.
+	Id interface{} `msgpack:"id"`
+}
+
+// serverResponse represents a msgpack RPC response returned by the server.
+type serverResponse struct {
+	// The Object that was returned by the invoked method. This must be nil
+	// in case there was an error invoking the method.
+	Result interface{} `msgpack:"result"`
+	// An Error object if there was an error invoking the method. It must be
+	// nil if there was no error.
+	Error interface{} `msgpack:"error"`
+	// This must be the same id as the request it is responding to.
+	Id interface{} `msgpack:"id"`
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new msgpack Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	return newCodecRequest(r)
+}
+
+// ContentTypes returns the media types of the responses of the codec, which
+// also encodes the responses to requests of other codecs accepting them.
+func (c *Codec) ContentTypes() []string {
+	return []string{"application/msgpack"}
+}
+
+// NewResponse returns the encoder of the response to a request decoded by
+// another codec. The response has a nil id.
+func (c *Codec) NewResponse(r *http.Request) rpc.ResponseEncoder {
+	return &CodecRequest{request: new(serverRequest)}
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns a new CodecRequest.
+func newCodecRequest(r *http.Request) rpc.CodecRequest {
+	// Decode the request body and check if RPC method is valid. Trailing
+	// data is always rejected.
+	req := new(serverRequest)
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err == nil {
+		depth := maxDepth
+		if max := rpc.MaxDecodeDepthFromContext(r.Context()); max > 0 {
+			depth = max
+		}
+		err = unmarshal(body, req, depth)
+	}
+	return &CodecRequest{request: req, err: err}
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request *serverRequest
+	err     error
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return c.request.Method, nil
+	}
+	return "", c.err
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil {
+		if len(c.request.Params) > 0 && c.request.Params[0] != 0xc0 {
+			// Params is an array value. RPC params is struct.
+			// Unmarshal into array containing the request struct.
+			params := [1]interface{}{args}
+			c.err = Unmarshal(c.request.Params, &params)
+		} else {
+			c.err = errors.New("rpc: method request ill-formed: missing params field")
+		}
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	res := &serverResponse{
+		Result: reply,
+		Id:     c.request.Id,
+	}
+	c.writeServerResponse(w, 200, res)
+}
+
+// WriteError encodes the error and writes it to the ResponseWriter with the
+// given status. The data of an *Error and an *rpc.Error, as an object with
+// its code, are encoded as is, and other errors as their message.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
+	res := &serverResponse{
+		Id: c.request.Id,
+	}
+	if msgpackErr, ok := err.(*Error); ok {
+		res.Error = msgpackErr.Data
+	} else if rpcErr, ok := err.(*rpc.Error); ok {
+		res.Error = rpcErr
+	} else {
+		res.Error = err.Error()
+	}
+	c.writeServerResponse(w, status, res)
+}
+
+func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, status int, res *serverResponse) {
+	b, err := Marshal(res)
+	if err != nil {
+		rpc.WriteError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,118 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResponseCodec is implemented by codecs able to encode the responses to
+// requests decoded by other codecs. Such a codec is chosen when it produces
+// a media type listed in the Accept header of the request before the
+// Content-Type of the request or */*.
+type ResponseCodec interface {
+	Codec
+	// ContentTypes returns the media types of the responses, e.g.
+	// "application/msgpack".
+	ContentTypes() []string
+	// NewResponse returns the encoder of the response to a request decoded
+	// by another codec.
+	NewResponse(r *http.Request) ResponseEncoder
+}
+
+// ResponseEncoder writes the response to a request, see ResponseCodec.
+type ResponseEncoder interface {
+	// Writes the reply of a successful call.
+	WriteResponse(w http.ResponseWriter, reply interface{})
+	// Writes an error with its status code, and the reply if any.
+	WriteError(w http.ResponseWriter, status int, err error, reply interface{})
+}
+
+// updateResponseCodecs indexes the registered response codecs by the media
+// types they produce.
+func (s *Server) updateResponseCodecs() {
+	s.responseCodecs = nil
+	for _, c := range s.codecs {
+		rc, ok := c.(ResponseCodec)
+		if !ok {
+			continue
+		}
+		if s.responseCodecs == nil {
+			s.responseCodecs = make(map[string]ResponseCodec)
+		}
+		for _, contentType := range rc.ContentTypes() {
+			s.responseCodecs[strings.ToLower(contentType)] = rc
+		}
+	}
+}
+
+// responseCodecFor returns the codec to encode the response to a request of
+// the given content type and the media type accepted it produces, or nil if
+// the request codec should encode it.
+func (s *Server) responseCodecFor(r *http.Request, contentType string) (ResponseCodec, string) {
+	accept := r.Header.Get("Accept")
+	if accept == "" || s.responseCodecs == nil {
+		return nil, ""
+	}
+	contentType = strings.ToLower(contentType)
+	for _, mediaType := range acceptedTypes(accept) {
+		if mediaType == "*/*" || mediaType == contentType {
+			return nil, ""
+		}
+		if rc, ok := s.responseCodecs[mediaType]; ok {
+			return rc, mediaType
+		}
+	}
+	return nil, ""
+}
+
+// acceptedTypes returns the media types of an Accept header, by decreasing
+// quality, leaving out those with a zero quality.
+func acceptedTypes(accept string) []string {
+	type accepted struct {
+		mediaType string
+		q         float64
+	}
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		a := accepted{mediaType: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, param := range params[1:] {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					a.q = q
+				}
+			}
+		}
+		if a.mediaType != "" && a.q > 0 {
+			types = append(types, a)
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool { return types[i].q > types[j].q })
+	mediaTypes := make([]string, len(types))
+	for i, a := range types {
+		mediaTypes[i] = a.mediaType
+	}
+	return mediaTypes
+}
+
+// negotiatedRequest is a CodecRequest whose response is written by the
+// encoder of another codec. Streams are buffered.
+type negotiatedRequest struct {
+	CodecRequest
+	response ResponseEncoder
+}
+
+func (c *negotiatedRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	c.response.WriteResponse(w, reply)
+}
+
+func (c *negotiatedRequest) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
+	c.response.WriteError(w, status, err, reply)
+}
@@ -0,0 +1,24 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import "net/http"
+
+// notificationWriter discards the response to a notification, headers
+// included. See NotificationCodecRequest.
+type notificationWriter struct {
+	header http.Header
+}
+
+func (w *notificationWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *notificationWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *notificationWriter) WriteHeader(int) {}
@@ -0,0 +1,76 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build otel
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otelScope is the instrumentation scope of the OpenTelemetry tracers.
+const otelScope = "github.com/oh-go/rpc/v2"
+
+// SetTracerProvider enables tracing of the requests with the OpenTelemetry
+// tracers of tp, as SetTracer does. The trace sent by clients is continued
+// using the global propagator, see otel.SetTextMapPropagator, and the spans
+// of the requests get the status code of the response in the
+// "http.response.status_code" attribute. A nil tp disables tracing. It is
+// only built with the "otel" tag, so the package doesn't depend on
+// OpenTelemetry otherwise.
+func (s *Server) SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		s.SetTracer(nil)
+		return
+	}
+	s.SetTracer(otelTracer{tp.Tracer(otelScope)})
+}
+
+// The adapters must keep implementing the optional interfaces, which the
+// server would otherwise silently skip.
+var (
+	_ HeaderTracer = otelTracer{}
+	_ StatusSpan   = otelSpan{}
+)
+
+// otelTracer adapts an OpenTelemetry tracer to Tracer.
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span}
+}
+
+func (t otelTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// otelSpan adapts an OpenTelemetry span to StatusSpan.
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) SetStatus(code int) {
+	s.span.SetAttributes(attribute.Int("http.response.status_code", code))
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,69 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build otel
+
+package rpc
+
+import (
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetTracerProvider(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	for _, test := range []struct {
+		method string
+		body   string
+		spans  string
+		status int64
+		failed bool
+	}{
+		{"Service1.multiply", `{"A":2,"B":5}`, "decode, handler, encode, Service1.multiply", 200, false},
+		{"Service3.err", `{"A":3}`, "decode, handler, encode, Service3.err", 400, true},
+	} {
+		recorder := tracetest.NewSpanRecorder()
+		s := newMockJSONServer()
+		s.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		r := newMockJSONRequest(test.method, test.body)
+		r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+
+		// Spans are recorded as they end, the request span last.
+		ended := recorder.Ended()
+		var names []string
+		for _, span := range ended {
+			names = append(names, span.Name())
+			if id := span.SpanContext().TraceID().String(); id != traceID {
+				t.Errorf("Trace of span %s was %s, should be %s.", span.Name(), id, traceID)
+			}
+		}
+		if got := strings.Join(names, ", "); got != test.spans {
+			t.Fatalf("Spans were %q, should be %q.", got, test.spans)
+		}
+		span := ended[len(ended)-1]
+		var status attribute.Value
+		for _, attr := range span.Attributes() {
+			if attr.Key == "http.response.status_code" {
+				status = attr.Value
+			}
+		}
+		if status.AsInt64() != test.status {
+			t.Errorf("%s: status attribute was %v, should be %d.", test.method, status.Emit(), test.status)
+		}
+		if failed := span.Status().Code == codes.Error; failed != test.failed || failed != (len(span.Events()) > 0) {
+			t.Errorf("%s: span status was %v with %d events, failed should be %v.", test.method, span.Status(), len(span.Events()), test.failed)
+		}
+	}
+}
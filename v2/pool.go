@@ -0,0 +1,123 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// ErrWorkerPoolFull is returned when a method can't be called because the
+// worker pool and its queue are full. The server responds with a 503.
+var ErrWorkerPoolFull = errors.New("rpc: worker pool is full")
+
+// SetWorkerPool makes the server call the regular methods on a pool of size
+// goroutines, bounding the number of running handlers under load spikes.
+// Up to size more calls wait in a queue; requests beyond that are rejected
+// with a 503 and ErrWorkerPoolFull. Streaming methods are not pooled.
+//
+// It may be called while serving: the calls already queued are run by the
+// old pool, the new ones by the new pool. A size of zero, the default,
+// calls the methods on the request goroutine.
+func (s *Server) SetWorkerPool(size int) {
+	var pool *workerPool
+	if size > 0 {
+		pool = newWorkerPool(size)
+	}
+	if old, _ := s.workerPool.Swap(pool).(*workerPool); old != nil {
+		old.close()
+	}
+}
+
+// loadWorkerPool returns the worker pool, or nil if there is none.
+func (s *Server) loadWorkerPool() *workerPool {
+	pool, _ := s.workerPool.Load().(*workerPool)
+	return pool
+}
+
+// errWorkerPoolClosed is returned by submit once the pool is replaced.
+var errWorkerPoolClosed = errors.New("rpc: worker pool is closed")
+
+// workerPool runs jobs on a fixed number of goroutines.
+type workerPool struct {
+	mutex  sync.RWMutex // guards closed and closing jobs
+	closed bool
+	jobs   chan func()
+}
+
+// newWorkerPool starts a pool of size workers with a queue of size jobs.
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), size)}
+	for i := 0; i < size; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a job, failing with ErrWorkerPoolFull if the queue is full
+// or with errWorkerPoolClosed if the pool is closed.
+func (p *workerPool) submit(job func()) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return errWorkerPoolClosed
+	}
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		return ErrWorkerPoolFull
+	}
+}
+
+// close stops the workers once the queued jobs are done.
+func (p *workerPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+}
+
+// callPooled calls a regular method on the worker pool, if any, and waits
+// for it. Panics are propagated to the request goroutine so they don't kill
+// the worker.
+func (s *Server) callPooled(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	var err error
+	var panicked interface{}
+	done := make(chan struct{})
+	job := func() {
+		defer close(done)
+		defer func() { panicked = recover() }()
+		err = s.callMethod(r, method, serviceSpec, methodSpec, args, reply)
+	}
+	for {
+		pool := s.loadWorkerPool()
+		if pool == nil {
+			return s.callMethod(r, method, serviceSpec, methodSpec, args, reply)
+		}
+		errSubmit := pool.submit(job)
+		if errSubmit == ErrWorkerPoolFull {
+			return errSubmit
+		}
+		if errSubmit == nil {
+			break
+		}
+		// The pool was replaced in the meantime.
+	}
+	<-done
+	if panicked != nil {
+		panic(panicked)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+)
+
+// EnablePooling makes the server reuse the args and replies of the methods,
+// zeroed, from a pool per method instead of allocating them per request.
+//
+// The values are returned to the pool once the response is written, so
+// codecs must not retain the args after ReadRequest or the reply after
+// WriteResponse, and neither must the methods after they return nor the
+// instrument funcs. Streaming and cached methods, methods with allocators
+// or factories and servers with a request timeout don't pool their values.
+func (s *Server) EnablePooling(enabled bool) {
+	s.pooling = enabled
+}
+
+// pooledValues are the args and reply of a method, kept in its pool.
+type pooledValues struct {
+	method      *serviceMethod
+	args, reply reflect.Value
+}
+
+// canPool reports whether the values of the method can be pooled.
+func (s *Server) canPool(method string, spec *serviceMethod) bool {
+	return s.pooling && spec.allocator == nil && !spec.hasFactory() && !spec.stream &&
+		s.requestTimeout == 0 && s.methodCaches[method] == nil
+}
+
+// getValues returns args and reply from the pool, or new ones.
+func (m *serviceMethod) getValues() *pooledValues {
+	if v, ok := m.values.Get().(*pooledValues); ok {
+		return v
+	}
+	return &pooledValues{m, reflect.New(m.argsType), reflect.New(m.replyType)}
+}
+
+// release zeroes args and reply and returns them to the pool.
+func (v *pooledValues) release() {
+	v.args.Elem().Set(reflect.Zero(v.method.argsType))
+	v.reply.Elem().Set(reflect.Zero(v.method.replyType))
+	v.method.values.Put(v)
+}
@@ -0,0 +1,34 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"runtime/pprof"
+)
+
+// PprofMethodLabel is the pprof label holding the method being served.
+const PprofMethodLabel = "rpc.method"
+
+// SetPprofLabels makes the server call the methods with the PprofMethodLabel
+// pprof label set to the method name, in the dotted notation, so CPU
+// profiles can be broken down by method.
+func (s *Server) SetPprofLabels(enabled bool) {
+	s.pprofLabels = enabled
+}
+
+// withPprofLabels calls f with the request, labelled with the method if
+// enabled.
+func (s *Server) withPprofLabels(r *http.Request, method string, f func(r *http.Request)) {
+	if !s.pprofLabels {
+		f(r)
+		return
+	}
+	pprof.Do(r.Context(), pprof.Labels(PprofMethodLabel, method), func(ctx context.Context) {
+		f(r.WithContext(ctx))
+	})
+}
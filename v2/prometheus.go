@@ -0,0 +1,59 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build prometheus
+
+package rpc
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsDesc = prometheus.NewDesc("rpc_requests_total",
+		"Number of RPC requests served.", []string{"method", "status"}, nil)
+	errorsDesc = prometheus.NewDesc("rpc_errors_total",
+		"Number of RPC requests failed.", []string{"method", "status"}, nil)
+	durationDesc = prometheus.NewDesc("rpc_request_duration_seconds",
+		"Duration of the RPC requests.", []string{"method", "status"}, nil)
+)
+
+// PrometheusCollector returns a collector of the metrics of the requests
+// served, the ones exposed by MetricsHandler, to be registered with a
+// Prometheus registry once metrics are enabled with EnableMetrics. It is
+// only built with the "prometheus" tag, so the package doesn't depend on
+// the Prometheus client otherwise.
+func (s *Server) PrometheusCollector() prometheus.Collector {
+	return prometheusCollector{s}
+}
+
+// prometheusCollector collects the metrics recorded by a server.
+type prometheusCollector struct {
+	server *Server
+}
+
+func (c prometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- requestsDesc
+	ch <- errorsDesc
+	ch <- durationDesc
+}
+
+func (c prometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, sample := range c.server.metrics.snapshot() {
+		status := strconv.Itoa(sample.status)
+		ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue,
+			float64(sample.count), sample.method, status)
+		ch <- prometheus.MustNewConstMetric(errorsDesc, prometheus.CounterValue,
+			float64(sample.errors), sample.method, status)
+		buckets := make(map[float64]uint64, len(metricBuckets))
+		for i, le := range metricBuckets {
+			buckets[le] = sample.buckets[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(durationDesc, sample.count, sample.sum,
+			buckets, sample.method, status)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build prometheus
+
+package rpc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	s := newMockJSONServer()
+	s.EnableMetrics()
+	c := s.PrometheusCollector()
+
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if n := testutil.CollectAndCount(c, "rpc_requests_total"); n != 1 {
+		t.Errorf("Collected %d request counters, should be 1.", n)
+	}
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.random123", `{}`))
+	expected := `
+# HELP rpc_requests_total Number of RPC requests served.
+# TYPE rpc_requests_total counter
+rpc_requests_total{method="Service1.multiply",status="200"} 2
+rpc_requests_total{method="unknown",status="404"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "rpc_requests_total"); err != nil {
+		t.Error(err)
+	}
+}
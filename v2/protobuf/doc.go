@@ -0,0 +1,43 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package protobuf provides a codec for RPC over HTTP services whose args and
+replies are protocol buffers messages.
+
+It is only built with the "protobuf" tag, so the module doesn't depend on
+google.golang.org/protobuf otherwise.
+
+To register the codec in a RPC server:
+
+	import (
+		"http"
+		"github.com/oh-go/rpc/v2"
+		"github.com/oh-go/rpc/v2/protobuf"
+	)
+
+	func init() {
+		codec := protobuf.NewCodec()
+		codec.RegisterProtoMethod("Arith.multiply", new(pb.MultiplyRequest), new(pb.MultiplyResponse))
+		s := rpc.NewServer()
+		s.RegisterCodec(codec, "application/x-protobuf")
+		// [...]
+		http.Handle("/rpc", s)
+	}
+
+The method is read from the X-Rpc-Method header, in dotted notation as in
+"Service.Method", and the body is the marshaled request message. The body
+of the response is the marshaled reply message, or the error message as
+plain text with the status of the error.
+
+The args and reply of the methods called through the codec must be pointers
+to the very message types registered for them, as in:
+
+	func (t *Arith) Multiply(r *http.Request, req *pb.MultiplyRequest, res *pb.MultiplyResponse) error
+
+Calls to methods without registered messages, or whose args or reply are of
+other types, fail.
+*/
+package protobuf
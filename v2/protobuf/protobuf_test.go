@@ -0,0 +1,110 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build protobuf
+
+package protobuf
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oh-go/rpc/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type Service1 struct {
+}
+
+func (t *Service1) Square(r *http.Request, req *wrapperspb.Int64Value, res *wrapperspb.Int64Value) error {
+	res.Value = req.Value * req.Value
+	return nil
+}
+
+func (t *Service1) Describe(r *http.Request, req *wrapperspb.Int64Value, res *wrapperspb.StringValue) error {
+	res.Value = "number"
+	return nil
+}
+
+func execute(t *testing.T, s *rpc.Server, method string, req proto.Message) *httptest.ResponseRecorder {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	if method != "" {
+		r.Header.Set(MethodHeader, method)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestService(t *testing.T) {
+	codec := NewCodec()
+	codec.RegisterProtoMethod("Service1.square", new(wrapperspb.Int64Value), new(wrapperspb.Int64Value))
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/x-protobuf")
+	s.RegisterService(new(Service1), "")
+
+	w := execute(t, s, "Service1.square", wrapperspb.Int64(7))
+	if w.Code != 200 {
+		t.Fatalf("Expected response code to be 200, but got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-protobuf" {
+		t.Errorf("Expected Content-Type to be application/x-protobuf, but got %q", ct)
+	}
+	var res wrapperspb.Int64Value
+	if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Value != 49 {
+		t.Error("Expected res.Value to be 49, but got", res.Value)
+	}
+}
+
+func TestUnregisteredMethod(t *testing.T) {
+	codec := NewCodec()
+	codec.RegisterProtoMethod("Service1.describe", new(wrapperspb.StringValue), new(wrapperspb.StringValue))
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/x-protobuf")
+	s.RegisterService(new(Service1), "")
+
+	for _, method := range []string{"", "Service1.square", "Service1.describe"} {
+		if w := execute(t, s, method, wrapperspb.Int64(7)); w.Code != 400 {
+			t.Errorf("%q: Expected response code to be 400, but got %d", method, w.Code)
+		}
+	}
+}
+
+func TestInvalidBody(t *testing.T) {
+	codec := NewCodec()
+	codec.RegisterProtoMethod("Service1.square", new(wrapperspb.Int64Value), new(wrapperspb.Int64Value))
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/x-protobuf")
+	s.RegisterService(new(Service1), "")
+	s.SetMaxBodyBytes(8)
+
+	for _, test := range []struct {
+		body []byte
+		code int
+	}{
+		{[]byte{0x08}, 400}, // truncated varint
+		{bytes.Repeat([]byte{0x08, 0x01}, 8), 413},
+	} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-protobuf")
+		r.Header.Set(MethodHeader, "Service1.square")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%x: Expected response code to be %d, but got %d: %s", test.body, test.code, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build protobuf
+
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/oh-go/rpc/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// MethodHeader is the request header holding the method to be invoked.
+const MethodHeader = "X-Rpc-Method"
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new protobuf Codec.
+func NewCodec() *Codec {
+	return &Codec{methods: make(map[string]protoMethod)}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+	mutex   sync.RWMutex
+	methods map[string]protoMethod
+}
+
+// protoMethod holds the message types registered for a method.
+type protoMethod struct {
+	reqType  reflect.Type
+	respType reflect.Type
+}
+
+// RegisterProtoMethod registers the request and response message types of
+// a method, in dotted notation as in "Service.Method" as sent by clients.
+// req and resp are only used for their types, which must be those of the
+// args and reply of the method. Registering a method again replaces its
+// types.
+func (c *Codec) RegisterProtoMethod(method string, req, resp proto.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.methods[method] = protoMethod{reflect.TypeOf(req), reflect.TypeOf(resp)}
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	req := &CodecRequest{method: r.Header.Get(MethodHeader)}
+	req.body, req.err = io.ReadAll(r.Body)
+	r.Body.Close()
+	if req.err == nil && req.method == "" {
+		req.err = errors.New("rpc: method request ill-formed: missing " + MethodHeader + " header")
+	}
+	c.mutex.RLock()
+	req.types, req.registered = c.methods[req.method]
+	c.mutex.RUnlock()
+	return req
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	method     string
+	body       []byte
+	types      protoMethod
+	registered bool
+	err        error
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return c.method, nil
+	}
+	return "", c.err
+}
+
+// ReadRequest unmarshals the request message into args, which must be of the
+// type registered for the method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if !c.registered {
+		c.err = fmt.Errorf("rpc: no proto messages registered for %q", c.method)
+		return c.err
+	}
+	msg, ok := args.(proto.Message)
+	if !ok || reflect.TypeOf(args) != c.types.reqType {
+		c.err = fmt.Errorf("rpc: args of %q are %T, not the registered %s", c.method, args, c.types.reqType)
+		return c.err
+	}
+	if err := proto.Unmarshal(c.body, msg); err != nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// WriteResponse marshals the reply message and writes it to the
+// ResponseWriter.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	msg, ok := reply.(proto.Message)
+	if !ok || reflect.TypeOf(reply) != c.types.respType {
+		err := fmt.Sprintf("rpc: reply of %q is %T, not the registered %s", c.method, reply, c.types.respType)
+		rpc.WriteError(w, 500, err)
+		return
+	}
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		rpc.WriteError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// WriteError writes the error message as plain text with the given status.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
+	rpc.WriteError(w, status, err.Error())
+}
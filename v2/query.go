@@ -0,0 +1,72 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// QueryPayloadParam is the query parameter holding the request of GET
+// requests, see RegisterQueryCodec.
+const QueryPayloadParam = "payload"
+
+// RegisterQueryCodec registers a codec serving GET requests, for clients
+// limited to plain links. The codec reads the request, e.g. the URL-encoded
+// JSON {"method":...,"params":...} for the JSON codec, from the
+// QueryPayloadParam query parameter instead of the body.
+//
+// Only the methods declared with SetReadOnlyMethods are served, others are
+// rejected with a 405.
+func (s *Server) RegisterQueryCodec(codec Codec) {
+	s.queryCodec = &payloadCodec{codec: codec}
+}
+
+// payloadCodec is a Codec reading the request from the payload parameter.
+type payloadCodec struct {
+	codec Codec
+}
+
+// NewRequest returns a CodecRequest of the wrapped codec, reading the
+// payload parameter as the body.
+func (c *payloadCodec) NewRequest(r *http.Request) CodecRequest {
+	payload := r.URL.Query().Get(QueryPayloadParam)
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body = io.NopCloser(strings.NewReader(payload))
+	r2.ContentLength = int64(len(payload))
+	return c.codec.NewRequest(r2)
+}
+
+// QueryCodec is implemented by codecs able to read requests from the query
+// string of GET requests, see AllowGET.
+type QueryCodec interface {
+	Codec
+	// NewRequestFromQuery returns a CodecRequest reading the method and
+	// args from the query string.
+	NewRequestFromQuery(r *http.Request) CodecRequest
+}
+
+// AllowGET makes the server serve GET requests with the codec selected as
+// for POST requests, which must implement QueryCodec. GET requests are
+// rejected with a 405 by default. A codec registered with
+// RegisterQueryCodec takes precedence.
+//
+// Only the methods declared with SetReadOnlyMethods are served, others are
+// rejected with a 405.
+func (s *Server) AllowGET(allow bool) {
+	s.allowGET = allow
+}
+
+// fromQueryCodec is a Codec reading requests with NewRequestFromQuery.
+type fromQueryCodec struct {
+	codec QueryCodec
+}
+
+func (c fromQueryCodec) NewRequest(r *http.Request) CodecRequest {
+	return c.codec.NewRequestFromQuery(r)
+}
@@ -0,0 +1,79 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is the request budget reported by a RateLimiter.
+type RateLimit struct {
+	Limit     int       // requests allowed per window
+	Remaining int       // requests left in the current window
+	Reset     time.Time // end of the current window
+}
+
+// RateLimiter decides whether a request may be served.
+type RateLimiter interface {
+	// Allow reports whether the request may be served and the budget left
+	// once it is counted.
+	Allow(r *http.Request) (bool, RateLimit)
+}
+
+// SetRateLimiter makes the server reject the requests not allowed by l with
+// a 429. The budget is reported on every response in the X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset headers, the latter as a Unix
+// time in seconds. Rejected responses also get a Retry-After header.
+func (s *Server) SetRateLimiter(l RateLimiter) {
+	s.rateLimiter = l
+}
+
+// NewRateLimiter returns a RateLimiter allowing limit requests per window
+// for the whole server.
+func NewRateLimiter(limit int, window time.Duration) RateLimiter {
+	return &fixedWindowLimiter{limit: limit, window: window}
+}
+
+// fixedWindowLimiter counts the requests of consecutive windows.
+type fixedWindowLimiter struct {
+	limit  int
+	window time.Duration
+	mutex  sync.Mutex
+	reset  time.Time
+	count  int
+}
+
+func (l *fixedWindowLimiter) Allow(r *http.Request) (bool, RateLimit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if !now.Before(l.reset) {
+		l.reset, l.count = now.Add(l.window), 0
+	}
+	allowed := l.count < l.limit
+	if allowed {
+		l.count++
+	}
+	return allowed, RateLimit{Limit: l.limit, Remaining: l.limit - l.count, Reset: l.reset}
+}
+
+// allow applies the rate limiter, setting the rate limit headers on the
+// response.
+func (s *Server) allow(w http.ResponseWriter, r *http.Request) bool {
+	allowed, limit := s.rateLimiter.Allow(r)
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(limit.Reset.Unix(), 10))
+	if !allowed {
+		seconds := (time.Until(limit.Reset) + time.Second - 1) / time.Second
+		h.Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+	return allowed
+}
@@ -0,0 +1,81 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// SetReadTimeout sets the maximum duration for reading the body of the
+// requests until their args are decoded, to protect against clients sending
+// it slowly. Requests whose body isn't read in time get a 408.
+//
+// The timeout is a read deadline set on the connection, through
+// http.ResponseController, before the codec or the body hooks read the
+// body, and removed once the args are decoded. It has no effect with
+// response writers not supporting read deadlines. Zero, the default, means
+// no limit beyond the ones of the http.Server.
+func (s *Server) SetReadTimeout(d time.Duration) {
+	s.readTimeout = d
+}
+
+// readDeadline is the read deadline set on the connection of a request.
+type readDeadline struct {
+	controller *http.ResponseController
+	header     http.Header // header of the response
+	timedOut   bool        // whether reading the body timed out
+}
+
+// startReadDeadline sets the read deadline of the connection of the request,
+// and returns a copy of the request with its body recording whether it
+// times out.
+func (s *Server) startReadDeadline(w http.ResponseWriter, r *http.Request) *http.Request {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+		return r
+	}
+	d := &readDeadline{controller: rc, header: w.Header()}
+	r = r.WithContext(context.WithValue(r.Context(), readDeadlineKey, d))
+	r.Body = &readTimeoutBody{ReadCloser: r.Body, deadline: d}
+	return r
+}
+
+// clearReadDeadline removes the read deadline of the connection of the
+// request, if any, so that it doesn't expire while the method runs.
+func clearReadDeadline(r *http.Request) {
+	if d, ok := r.Context().Value(readDeadlineKey).(*readDeadline); ok {
+		d.controller.SetReadDeadline(time.Time{})
+	}
+}
+
+// readTimedOut reports whether reading the body of the request timed out,
+// whatever the error reported by the codec.
+func readTimedOut(r *http.Request) bool {
+	d, ok := r.Context().Value(readDeadlineKey).(*readDeadline)
+	return ok && d.timedOut
+}
+
+// readTimeoutBody records the timeouts reading a request body.
+type readTimeoutBody struct {
+	io.ReadCloser
+	deadline *readDeadline
+}
+
+func (b *readTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var ne net.Error
+	if err != nil && errors.As(err, &ne) && ne.Timeout() {
+		// The rest of the body can't be read to reuse the connection.
+		b.deadline.timedOut = true
+		b.deadline.header.Set("Connection", "close")
+	}
+	return n, err
+}
@@ -0,0 +1,72 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// RecordedRequest is a request captured by the function set with
+// SetRequestRecorder, to be run again with Replay.
+type RecordedRequest struct {
+	Method string // informative, the codec reads it from the body
+	Body   []byte
+	Status int // status of the recorded response, 0 if it was not written
+	// ContentType selects the codec. If empty the request is served by the
+	// codec registered with an empty content type, or the only codec.
+	ContentType string
+}
+
+// SetRequestRecorder sets a function called after each request whose body
+// has been read, with the method, the raw body and the status of the
+// response, e.g. to keep failed requests for offline debugging with Replay.
+// The body is buffered as for body hooks; see RegisterBodyHook.
+func (s *Server) SetRequestRecorder(f func(method string, body []byte, status int)) {
+	s.requestRecorder = f
+}
+
+// Replay serves a recorded request again and returns the status and body of
+// the response. The request is a POST to "/" without other headers.
+func (s *Server) Replay(rec RecordedRequest) (status int, body []byte) {
+	r, err := http.NewRequest("POST", "/", bytes.NewReader(rec.Body))
+	if err != nil {
+		return 0, nil
+	}
+	if rec.ContentType != "" {
+		r.Header.Set("Content-Type", rec.ContentType)
+	}
+	w := &replayWriter{header: make(http.Header)}
+	s.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.status, w.body.Bytes()
+}
+
+// replayWriter keeps the response to a replayed request.
+type replayWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *replayWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.body.Write(p)
+}
+
+func (w *replayWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// methodRetry is the retry policy of a method set by SetMethodRetry.
+type methodRetry struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// SetMethodRetry makes the server call the method up to attempts times
+// while it fails with a retryable error, as reported by IsRetryable,
+// waiting backoff between attempts. Other errors are returned at once.
+//
+// The method uses a dotted notation as in "Service.Method". It should only
+// be set for idempotent methods: each attempt gets the same args and a new
+// reply. Streaming methods are never retried. An attempts value of one or
+// less disables retries.
+func (s *Server) SetMethodRetry(method string, attempts int, backoff time.Duration) {
+	method = s.services.canonical(method)
+	if s.methodRetries == nil {
+		s.methodRetries = make(map[string]methodRetry)
+	}
+	if attempts <= 1 {
+		delete(s.methodRetries, method)
+		return
+	}
+	s.methodRetries[method] = methodRetry{attempts: attempts, backoff: backoff}
+}
+
+// callMethod calls a regular method through the middlewares added with
+// Wrap, retrying it as set by SetMethodRetry. Retries stop early if the
+// request context is done.
+func (s *Server) callMethod(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	call := s.callAttempts
+	if len(s.middlewares) > 0 {
+		call = s.callWrapped
+	}
+	if s.pprofLabels {
+		var err error
+		s.withPprofLabels(r, method, func(r *http.Request) {
+			err = call(r, method, serviceSpec, methodSpec, args, reply)
+		})
+		return err
+	}
+	return call(r, method, serviceSpec, methodSpec, args, reply)
+}
+
+// callAttempts calls a method as many times as allowed by its retry policy.
+func (s *Server) callAttempts(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	retry := s.methodRetries[method]
+	for attempt := 1; ; attempt++ {
+		err := methodSpec.call(serviceSpec.rcvr, reflect.ValueOf(r), args, reply)
+		if err == nil || attempt >= retry.attempts {
+			return err
+		}
+		if retryable, _ := IsRetryable(err); !retryable {
+			return err
+		}
+		timer := time.NewTimer(retry.backoff)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return err
+		}
+		reply.Elem().Set(reflect.Zero(methodSpec.replyType))
+	}
+}
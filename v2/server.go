@@ -6,10 +6,14 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +39,56 @@ type CodecRequest interface {
 	WriteError(w http.ResponseWriter, status int, err error, reply interface{})
 }
 
+// CheckedCodecRequest is implemented by codec requests reporting whether
+// the response could be encoded and written.
+//
+// For codec requests not implementing it, only the errors returned by the
+// writer are seen by the server.
+type CheckedCodecRequest interface {
+	CodecRequest
+	// Writes the response using the RPC method reply, returning the error
+	// that prevented it, if any.
+	WriteResponseChecked(w http.ResponseWriter, reply interface{}) error
+}
+
+// StreamingCodecRequest is implemented by codec requests able to encode the
+// values sent by a streaming method as they arrive, e.g. as a JSON array.
+//
+// Codec requests not implementing it get the values collected in a slice and
+// passed to WriteResponse once the method returns.
+type StreamingCodecRequest interface {
+	CodecRequest
+	// Writes the beginning of the stream, before the first value.
+	WriteStreamStart(w http.ResponseWriter) error
+	// Writes a value sent by the method.
+	WriteStreamValue(w http.ResponseWriter, value interface{}) error
+	// Writes the end of the stream, including the error that interrupted
+	// it, if any.
+	WriteStreamEnd(w http.ResponseWriter, err error) error
+}
+
+// NotificationCodecRequest is implemented by codec requests able to tell
+// calls expecting no response, such as JSON-RPC 2.0 notifications.
+//
+// The method of a notification is called and instrumented as for other
+// calls, but whatever the codec writes, including errors, is discarded and
+// the response is a 204 without a body. The status code reported to the
+// instrument and after funcs is still the one of the call, e.g. a 404 for an
+// unknown method. Calls of a batch that are notifications are left out of
+// its response.
+type NotificationCodecRequest interface {
+	CodecRequest
+	// Reports whether the request is a notification.
+	IsNotification() bool
+}
+
+// Validator is implemented by args checking their own invariants. The server
+// calls Validate once the args are decoded, and responds with a 400 instead
+// of calling the method if it fails.
+type Validator interface {
+	Validate() error
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
@@ -42,8 +96,10 @@ type CodecRequest interface {
 // NewServer returns a new RPC server.
 func NewServer() *Server {
 	return &Server{
-		codecs:   make(map[string]Codec),
-		services: new(serviceMap),
+		codecs:             make(map[string]Codec),
+		services:           new(serviceMap),
+		maxBatchSize:       DefaultMaxBatchSize,
+		methodCacheEntries: DefaultMethodCacheEntries,
 	}
 }
 
@@ -53,30 +109,104 @@ type RequestInfo struct {
 	Error      error
 	Request    *http.Request
 	StatusCode int
+	RequestID  string // see SetRequestIDHeader
+	// Content type the codec of the request is registered for, and the
+	// Content-Type of the response if not the one of the codec, e.g. when
+	// negotiated with the Accept header.
+	ContentType, ResponseType string
 }
 
 // InterruptInfo contains
 type InterruptInfo struct {
 	Error      error
 	StatusCode int
+	// Response, if set and Error is nil, is written with the codec as the
+	// reply of the request instead of calling the method, e.g. a cached
+	// reply, with StatusCode or else a 200.
+	Response interface{}
+	// Headers are set on the response before the error or the response is
+	// written, e.g. Retry-After and X-RateLimit-* for a 429.
+	Headers http.Header
 }
 
 type InstrumentInfo struct {
 	Duration   time.Duration
 	Method     string
-	StatusCode int
+	StatusCode int // 0 if the response could not be written
 	Error      error
 	Args       reflect.Value
-	Reply      interface{}
+	Reply      interface{} // nil for streaming methods
 	Request    *http.Request
+	CacheKey   string // set when the method is cached, see SetMethodCache
+	CacheHit   bool   // whether the reply was served from the cache
+	RequestID  string // see SetRequestIDHeader
+	// See RequestInfo.
+	ContentType, ResponseType string
 }
 
 // Server serves registered RPC services using registered codecs.
 type Server struct {
-	codecs         map[string]Codec
-	services       *serviceMap
-	interruptFunc  func(i *RequestInfo) *InterruptInfo
-	instrumentFunc func(i *InstrumentInfo)
+	codecs             map[string]Codec
+	services           *serviceMap
+	interruptFuncs     []func(i *RequestInfo) *InterruptInfo
+	instrumentFuncs    []func(i *InstrumentInfo)
+	maxMethodLen       int
+	correlationHeaders []string
+	requestIDFunc      func() string
+	polymorphicTypes   map[string]reflect.Type
+	singleCodec        Codec
+	singleContentType  string
+	singleCodecFast    bool
+	serverTiming       bool
+	methodRetries      map[string]methodRetry
+	allowedTypes       map[string]bool
+	methodCaches       map[string]*methodCache
+	rejectUntilReady   bool
+	bodyHooks          []func(r *http.Request, body []byte) error
+	rateLimiter        RateLimiter
+	tracer             Tracer
+	prettyJSON         func(r *http.Request) bool
+	methodPrefix       string
+	deprecations       map[string]deprecation
+	readOnlyMethods    map[string]bool
+	maxDecodeDepth     int
+	errorLogger        func(r *http.Request, method string, status int, err error)
+	logger             Logger
+	afterFunc          func(i *RequestInfo)
+	flushInterval      int
+	fieldFilter        func(ctx context.Context, reply interface{}) interface{}
+	examples           map[string]methodExamples
+	strictTrailingData bool
+	pprofLabels        bool
+	queryCodec         Codec
+	workerPool         atomic.Value // *workerPool set by SetWorkerPool
+	requestRecorder    func(method string, body []byte, status int)
+	successStatuses    map[string]int
+	requestTimeout     time.Duration
+	allowGET           bool
+	maxBodyBytes       int64
+	compression        bool
+	errorStatus        func(code int) int
+	drain              drain
+	responseCodecs     map[string]ResponseCodec
+	responseTypes      map[string]string
+	readinessChecks    []readinessCheck
+	fallbackHandler    func(w http.ResponseWriter, r *http.Request, method string)
+	notFoundHandler    func(w http.ResponseWriter, r *http.Request, method string)
+	metrics            *metrics
+	successStatus      int
+	pooling            bool
+	serviceCodecs      map[string]string
+	serviceCodecTypes  []string
+	latency            *latencyStats
+	readTimeout        time.Duration
+	concurrency        chan struct{}
+	concurrencyWait    time.Duration
+	middlewares        []func(next HandlerFunc) HandlerFunc
+	maxBatchSize       int
+	batchConcurrency   chan struct{}
+	queueBatches       bool
+	methodCacheEntries int
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -84,8 +214,103 @@ type Server struct {
 // Codecs are defined to process a given serialization scheme, e.g., JSON or
 // XML. A codec is chosen based on the "Content-Type" header from the request,
 // excluding the charset definition.
+//
+// The response is written by the codec of the request, unless the Accept
+// header prefers a media type produced by another codec; see ResponseCodec.
+// Its Content-Type is the one set by the codec, unless the codec implements
+// ContentTypeCodec; see also RegisterCodecWithContentType.
 func (s *Server) RegisterCodec(codec Codec, contentType string) {
 	s.codecs[strings.ToLower(contentType)] = codec
+	s.updateSingleCodec()
+	s.updateResponseCodecs()
+	responseType := ""
+	if c, ok := codec.(ContentTypeCodec); ok {
+		responseType = c.ContentType()
+	}
+	s.setResponseType(contentType, responseType)
+}
+
+// RegisterCodecTypes registers the codec for each of the content types, as
+// RegisterCodec does, e.g. for "application/json" and "application/json-rpc".
+// Like RegisterCodec, it replaces the codecs already registered for them.
+func (s *Server) RegisterCodecTypes(codec Codec, contentTypes ...string) {
+	for _, contentType := range contentTypes {
+		s.RegisterCodec(codec, contentType)
+	}
+}
+
+// updateSingleCodec caches the codec when only one has been registered. If
+// Content-Type is not set, requests then default to that codec.
+func (s *Server) updateSingleCodec() {
+	s.singleCodec, s.singleContentType = nil, ""
+	if len(s.codecs) == 1 {
+		for contentType, c := range s.codecs {
+			s.singleCodec, s.singleContentType = c, contentType
+		}
+	}
+}
+
+// RegisterFallbackCodec adds a codec to be tried when the codecs already
+// registered for the content type fail to decode a request.
+//
+// This allows serving several versions of a serialization scheme under the
+// same content type, e.g. trying a v2 decoder first and falling back to v1.
+// The response is written by the codec that managed to decode the request.
+//
+// A later call to RegisterCodec for the same content type replaces the whole
+// chain, fallbacks included.
+func (s *Server) RegisterFallbackCodec(codec Codec, contentType string) {
+	contentType = strings.ToLower(contentType)
+	switch c := s.codecs[contentType].(type) {
+	case nil:
+		s.codecs[contentType] = codec
+	case *codecChain:
+		c.codecs = append(c.codecs, codec)
+	default:
+		s.codecs[contentType] = &codecChain{codecs: []Codec{c, codec}}
+	}
+	s.updateSingleCodec()
+	s.updateResponseCodecs()
+}
+
+// SetMethodNameFunc sets the function transforming the method names, given
+// the service name, e.g. to keep them as declared or to use snake_case. It
+// is applied to the names of the methods registered and to those requested,
+// so both must match once transformed, and to the names given to the
+// settings of the methods, such as SetMethodCache.
+//
+// By default the names registered get their first letter lower-cased, as in
+// "Service.method", and the names requested are looked up as is. It must be
+// called before registering services, which fail if two of their methods
+// get the same name; see SetAllowOverwrite.
+func (s *Server) SetMethodNameFunc(f func(service, method string) string) {
+	s.services.methodName = f
+}
+
+// SetAllowOverwrite makes registering a service whose methods have the same
+// name once transformed, see SetMethodNameFunc, succeed with the last of
+// them in the order of their Go names, instead of failing. It must be
+// called before registering services.
+func (s *Server) SetAllowOverwrite(allowed bool) {
+	s.services.allowOverwrite = allowed
+}
+
+// SetCaseInsensitive makes the server look up the methods ignoring case, as
+// in "service1.MULTIPLY" for "Service1.multiply". The registered name is the
+// one reported to the interrupt and instrument funcs. Registering methods
+// whose names only differ by case then fails. It should be called before
+// registering services.
+func (s *Server) SetCaseInsensitive(enabled bool) {
+	s.services.setCaseInsensitive(enabled)
+}
+
+// SetServiceShards splits the registry of services across n shards, each
+// with its own lock, to reduce contention when looking up methods of many
+// services under heavy concurrency. It must be called before the server
+// starts serving requests. One shard, the default, is used if n is less
+// than two.
+func (s *Server) SetServiceShards(n int) {
+	s.services.setShards(n)
 }
 
 // RegisterService adds a new service to the server.
@@ -95,17 +320,76 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 //
 // Methods from the receiver will be extracted if these rules are satisfied:
 //
-//    - The receiver is exported (begins with an upper case letter) or local
-//      (defined in the package registering the service).
-//    - The method name is exported.
-//    - The method has three arguments: *http.Request, *args, *reply.
-//    - All three arguments are pointers.
-//    - The second and third arguments are exported or local.
-//    - The method has return type error.
+//   - The receiver is exported (begins with an upper case letter) or local
+//     (defined in the package registering the service).
+//   - The method name is exported.
+//   - The method has three arguments: *http.Request, *args, *reply.
+//   - All three arguments are pointers. The first may instead be a
+//     context.Context, which is passed the request context.
+//   - The second and third arguments are exported or local.
+//   - The method has return type error.
+//
+// Methods may also return their reply instead of taking *reply, as in
+// (*http.Request, *args) (*reply, error). A nil reply is encoded as the zero
+// value. Several replies can be returned, as in (*http.Request, *args) (r1,
+// r2, error); these are passed to the codec as a []interface{}, encoded as
+// an array by the JSON codecs.
+//
+// Methods not needing the request may omit it, as in (*args, *reply) error.
+//
+// Args for methods taking none can be declared as an empty struct, as in
+// *struct{}. The request body is then not decoded, so it may be empty.
+//
+// Streaming methods take a send-only channel in place of *reply, as in
+// (*http.Request, *args, chan<- T) error. The values sent on the channel are
+// encoded as they arrive; see StreamingCodecRequest. Such methods must stop
+// sending once the request context is done.
 //
 // All other methods are ignored.
 func (s *Server) RegisterService(receiver interface{}, name string) error {
-	return s.services.register(receiver, name)
+	return s.services.register(receiver, name, nil, nil)
+}
+
+// UnregisterService removes the service registered under the given name,
+// e.g. to retire a plugin at runtime. Its methods are no longer found once
+// it returns, while requests already calling them complete. The error
+// matches ErrServiceNotFound if no such service is registered.
+func (s *Server) UnregisterService(name string) error {
+	return s.services.unregister(name)
+}
+
+// RegisterServiceWithAllocators is like RegisterService, using the given
+// allocators for the args and reply of the methods instead of
+// reflect.New, e.g. returning preallocated values for hot methods. They
+// return pointers to the args and reply, or nil for either to have it
+// allocated by the server.
+//
+// The allocators are keyed by method name, as in "Multiply", and called
+// once at registration to check their types. Streaming methods can't have
+// one.
+//
+// The values must not be shared by concurrent requests, and must not be
+// reused before the response is written.
+func (s *Server) RegisterServiceWithAllocators(receiver interface{}, name string, allocators map[string]func() (args, reply interface{})) error {
+	return s.services.register(receiver, name, allocators, nil)
+}
+
+// RegisterServiceFiltered is like RegisterService, only registering the
+// methods for which include returns true, given their Go name, e.g. to
+// leave out internal methods of a suitable type. It fails if no method is
+// included.
+func (s *Server) RegisterServiceFiltered(receiver interface{}, name string, include func(methodName string) bool) error {
+	return s.services.register(receiver, name, nil, include)
+}
+
+// RegisterFunc adds a func as a method, registering its service if needed.
+//
+// The method uses a dotted notation as in "Service.Method". The func must
+// have the signature of a method without the receiver, as in
+// func(*http.Request, *args, *reply) error; see RegisterService. Adapt
+// builds such funcs from generic handlers.
+func (s *Server) RegisterFunc(method string, fn interface{}) error {
+	return s.services.registerFunc(method, fn)
 }
 
 // HasMethod returns true if the given method is registered.
@@ -118,116 +402,792 @@ func (s *Server) HasMethod(method string) bool {
 	return false
 }
 
+// ReplaceMethod replaces the implementation of a registered method at
+// runtime, e.g. to switch between handler implementations for A/B testing.
+//
+// The method uses a dotted notation as in "Service.Method". The function
+// must have the signature of the method without the receiver, as in
+// func(*http.Request, *args, *reply) error. Requests already being served
+// keep the implementation they started with.
+func (s *Server) ReplaceMethod(method string, fn interface{}) error {
+	return s.services.replace(method, fn)
+}
+
 // RegisterInterruptFunc registers the specified function as the function
 // that will be called before every request. The function is allowed to interrupt
 // the request.
 //
 // Note: Only one function can be registered, subsequent calls to this
-// method will overwrite all the previous functions.
+// method will overwrite all the previous functions, including those added
+// with AddInterruptFunc.
 func (s *Server) RegisterInterruptFunc(f func(i *RequestInfo) *InterruptInfo) {
-	s.interruptFunc = f
+	s.interruptFuncs = nil
+	if f != nil {
+		s.interruptFuncs = append(s.interruptFuncs, f)
+	}
+}
+
+// AddInterruptFunc adds a function called before every request, after the
+// functions already registered, e.g. to compose auth and logging. The first
+// function interrupting the request stops the chain. All the functions get
+// the same RequestInfo, so they see the changes made by the previous ones.
+func (s *Server) AddInterruptFunc(f func(i *RequestInfo) *InterruptInfo) {
+	s.interruptFuncs = append(s.interruptFuncs, f)
+}
+
+// SetErrorLogger sets a function called for every request failing, whether
+// rejected by the server or failed by the method, with the method name if
+// known, the status code of the response and the error. Unlike the
+// instrument func, it is also called for requests rejected before the
+// method is called.
+func (s *Server) SetErrorLogger(f func(r *http.Request, method string, status int, err error)) {
+	s.errorLogger = f
+}
+
+// RegisterAfterFunc registers a function called after the response of every
+// request is written, including requests rejected before the method is
+// called. It gets the method name if known, the error the request failed
+// with, if any, and the status code of the response.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite the previous one.
+func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
+	s.afterFunc = f
 }
 
 // RegisterInstrumentFunc register the func which will give request info and handler process duration
+//
+// It replaces all the previous funcs, including those added with
+// AddInstrumentFunc.
 func (s *Server) RegisterInstrumentFunc(f func(instrumentInfo *InstrumentInfo)) {
-	s.instrumentFunc = f
+	s.instrumentFuncs = nil
+	if f != nil {
+		s.instrumentFuncs = append(s.instrumentFuncs, f)
+	}
+}
+
+// AddInstrumentFunc adds a func called after every method call, after the
+// funcs already registered, e.g. to feed several metrics sinks. All the
+// funcs get the same InstrumentInfo.
+func (s *Server) AddInstrumentFunc(f func(instrumentInfo *InstrumentInfo)) {
+	s.instrumentFuncs = append(s.instrumentFuncs, f)
+}
+
+// RegisterPolymorphicType registers the concrete type of proto for the
+// given discriminator.
+//
+// Codecs supporting it, such as the JSON codec, use these types to decode
+// interface fields of the args: an object with a "type" member equal to
+// the discriminator is decoded into a new value of the type of proto. Types
+// must be registered before the server starts serving requests.
+func (s *Server) RegisterPolymorphicType(discriminator string, proto interface{}) {
+	if s.polymorphicTypes == nil {
+		s.polymorphicTypes = make(map[string]reflect.Type)
+	}
+	s.polymorphicTypes[discriminator] = reflect.TypeOf(proto)
+}
+
+// SetSingleCodecFastPath makes a server with a single registered codec use
+// it for every request, without looking at the Content-Type header. Requests
+// with a different content type are then served instead of rejected with a
+// 415.
+func (s *Server) SetSingleCodecFastPath(enabled bool) {
+	s.singleCodecFast = enabled
+}
+
+// SetRejectUntilReady makes the server reject requests with a 503 as long
+// as no service is registered, e.g. while the application is starting.
+func (s *Server) SetRejectUntilReady(enabled bool) {
+	s.rejectUntilReady = enabled
+}
+
+// SetAllowedContentTypes restricts the content types served to the given
+// ones: requests with any other Content-Type are rejected with a 415, even
+// if a codec is registered for it. Calling it without types removes the
+// restriction.
+func (s *Server) SetAllowedContentTypes(types ...string) {
+	s.allowedTypes = nil
+	if len(types) > 0 {
+		s.allowedTypes = make(map[string]bool, len(types))
+		for _, contentType := range types {
+			s.allowedTypes[strings.ToLower(contentType)] = true
+		}
+	}
+}
+
+// SetPrettyJSON sets a function telling whether JSON responses to a request
+// should be indented, e.g. when a "pretty" query parameter is set, for
+// debugging. Codecs supporting it, such as the JSON codecs, read the result
+// with PrettyJSONFromContext.
+func (s *Server) SetPrettyJSON(f func(r *http.Request) bool) {
+	s.prettyJSON = f
+}
+
+// SetFieldFilter sets a function shaping the replies before they are
+// encoded, e.g. to remove fields depending on the role of the caller found
+// in the context. It gets the reply, or each value sent by streaming
+// methods, and returns the value to encode instead. The reply must not be
+// modified in place if the method is cached.
+func (s *Server) SetFieldFilter(f func(ctx context.Context, reply interface{}) interface{}) {
+	s.fieldFilter = f
+}
+
+// filterReply applies the field filter to a reply.
+func (s *Server) filterReply(r *http.Request, reply interface{}) interface{} {
+	if s.fieldFilter == nil {
+		return reply
+	}
+	return s.fieldFilter(r.Context(), reply)
+}
+
+// SetServerTiming makes the server add a Server-Timing header to the
+// responses of regular methods, with the time spent decoding the args and
+// calling the method, as in "decode;dur=0.012, handler;dur=1.5". Durations
+// are in milliseconds. Streaming methods don't get the header.
+func (s *Server) SetServerTiming(enabled bool) {
+	s.serverTiming = enabled
+}
+
+// SetMaxBodyBytes sets the maximum size of the request bodies. Reading the
+// body past it fails, and the request is rejected with a 413. Gzip-encoded
+// bodies are limited once decompressed. Zero, the default, means no limit.
+func (s *Server) SetMaxBodyBytes(n int64) {
+	s.maxBodyBytes = n
+}
+
+// SetMaxDecodeDepth sets the maximum nesting depth of the request bodies,
+// counting the arrays and objects of the whole body, to protect against
+// malicious payloads. Codecs supporting it, such as the JSON codec, reject
+// deeper bodies, leading to a 400. Zero, the default, means no limit.
+func (s *Server) SetMaxDecodeDepth(n int) {
+	s.maxDecodeDepth = n
+}
+
+// SetStrictTrailingData makes the server reject requests with data
+// following the request, e.g. a second JSON object, with a 400. Codecs
+// supporting it, such as the JSON codec, ignore such data by default.
+func (s *Server) SetStrictTrailingData(strict bool) {
+	s.strictTrailingData = strict
+}
+
+// SetMethodPrefixTrim makes the server remove prefix from the method names
+// sent by clients before looking them up, e.g. "RPC." to serve
+// "RPC.Service.Method" as "Service.Method". Names without the prefix are
+// looked up as is.
+func (s *Server) SetMethodPrefixTrim(prefix string) {
+	s.methodPrefix = prefix
+}
+
+// SetMaxMethodNameLength sets the maximum length of the method names
+// accepted by the server. Requests for longer names are rejected with a 400
+// before the method is looked up. Zero, the default, means no limit.
+func (s *Server) SetMaxMethodNameLength(n int) {
+	s.maxMethodLen = n
+}
+
+// SetCorrelationHeaders enables correlation ids, read from the first of the
+// given headers present in the request, e.g. "X-Request-ID",
+// "X-Correlation-ID" or "traceparent". For traceparent the trace id is used.
+// If none is present a new id is generated, see SetRequestIDFunc.
+//
+// The id is stored in the request context, see CorrelationIDFromContext,
+// and echoed back in the header it was read from, or in the first header
+// when generated. Calling it without headers disables correlation ids.
+func (s *Server) SetCorrelationHeaders(names ...string) {
+	s.correlationHeaders = names
 }
 
 // ServeHTTP
+//
+// Request bodies sent with "Content-Encoding: gzip" are decompressed before
+// being decoded, and rejected with a 400 if they aren't valid gzip.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	var statusCode = 200
+	var method string
+	var failure error       // error the request was rejected with, if any
+	var served *RequestInfo // info of the call served, if any
+	var batched bool        // whether the calls of a batch were served
+	var match codecMatch
+	if s.afterFunc != nil {
+		defer func() {
+			info := served
+			if info == nil {
+				info = &RequestInfo{Method: method, Error: failure, Request: r, StatusCode: statusCode,
+					RequestID: CorrelationIDFromContext(r.Context()), ContentType: match.contentType}
+			}
+			s.afterFunc(info)
+		}()
+	}
+	if s.errorLogger != nil || s.logger != nil {
+		defer func() {
+			if failure != nil {
+				s.logFailure(r, method, statusCode, failure)
+			}
+		}()
+	}
+	if s.metrics != nil {
+		// The calls served record their own metrics, the requests rejected
+		// before are recorded here.
+		defer func() {
+			if served == nil && !batched {
+				s.metrics.observe(UnknownMethodLabel, statusCode, failure, time.Since(start))
+			}
+		}()
+	}
 
-	if r.Method != "POST" {
+	if len(s.correlationHeaders) > 0 {
+		r = s.withCorrelationID(w, r)
+	}
+	if !s.drain.enter() {
+		statusCode = 503
+		failure = errShuttingDown
+		rejectShutdown(w)
+		return
+	}
+	defer s.drain.active.Done()
+	if s.concurrency != nil {
+		release, ok := s.acquire(r)
+		if !ok {
+			statusCode = 503
+			failure = errTooManyRequests
+			WriteError(w, statusCode, failure.Error())
+			return
+		}
+		defer release()
+	}
+	if s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		r, cancel = s.withRequestTimeout(r)
+		defer cancel()
+	}
+	if r.Method == "HEAD" && s.readOnlyMethods != nil {
+		hw := &headResponseWriter{ResponseWriter: w, status: 200}
+		defer hw.finish()
+		w = hw
+	} else if r.Method != "POST" && (r.Method != "GET" || (s.queryCodec == nil && !s.allowGET)) {
 		statusCode = 405
-		WriteError(w, statusCode, "rpc: POST method required, received "+r.Method)
+		failure = errors.New("rpc: POST method required, received " + r.Method)
+		WriteError(w, statusCode, failure.Error())
 		return
 	}
-	contentType := r.Header.Get("Content-Type")
-	idx := strings.Index(contentType, ";")
-	if idx != -1 {
-		contentType = contentType[:idx]
+	if s.compression && acceptsGzip(r) {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.finish()
+		w = gw
 	}
+	if flusher, ok := w.(http.Flusher); ok && s.flushInterval > 0 {
+		w = &flushWriter{ResponseWriter: w, flusher: flusher, interval: s.flushInterval}
+	}
+	if s.rateLimiter != nil && !s.allow(w, r) {
+		statusCode = 429
+		failure = errors.New("rpc: rate limit exceeded")
+		WriteError(w, statusCode, failure.Error())
+		return
+	}
+	if s.rejectUntilReady && s.services.empty() {
+		statusCode = 503
+		failure = errors.New("rpc: no services registered yet")
+		WriteError(w, statusCode, failure.Error())
+		return
+	}
+	if s.readTimeout > 0 && r.Body != nil && r.Body != http.NoBody {
+		r = s.startReadDeadline(w, r)
+	}
+	if r.Body != nil && r.Body != http.NoBody && isGzipEncoded(r) {
+		var err error
+		if r, err = gunzipRequest(r); err != nil {
+			statusCode = readErrorStatus(r, err)
+			failure = err
+			WriteError(w, statusCode, "rpc: invalid gzip body: "+err.Error())
+			return
+		}
+	}
+	if s.maxBodyBytes > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	}
+	var contentType string
 	var codec Codec
-	if contentType == "" && len(s.codecs) == 1 {
-		// If Content-Type is not set and only one codec has been registered,
-		// then default to that codec.
-		for _, c := range s.codecs {
-			codec = c
+	if len(s.serviceCodecs) > 0 && r.Method != "GET" && r.Body != nil && r.Header.Get("Content-Type") == "" {
+		if r, contentType, codec, statusCode, failure = s.serviceCodecFor(r); failure != nil {
+			WriteError(w, statusCode, "rpc: "+failure.Error())
+			return
 		}
-	} else if codec = s.codecs[strings.ToLower(contentType)]; codec == nil {
+	}
+	if codec == nil {
+		contentType, codec = s.codecFor(r)
+	}
+	if codec == nil {
 		statusCode = 415
-		WriteError(w, statusCode, "rpc: unrecognized Content-Type: "+contentType)
+		failure = errors.New("rpc: unrecognized Content-Type: " + contentType)
+		WriteError(w, statusCode, failure.Error())
 		return
 	}
 
-	var errResult error
-	var args reflect.Value
-	// Create a new codec request.
+	match = codecMatch{contentType: strings.ToLower(contentType)}
+	rc, accepted := s.responseCodecFor(r, contentType)
+	if rc != nil {
+		match.responseType = accepted
+	} else if responseType := s.responseTypes[match.contentType]; responseType != "" {
+		match.responseType = responseType
+		w = &contentTypeWriter{ResponseWriter: w, contentType: responseType}
+	}
+
+	if len(s.bodyHooks) > 0 || s.requestRecorder != nil {
+		if r, statusCode, failure = s.runBodyHooks(r); failure != nil {
+			WriteError(w, statusCode, "rpc: "+failure.Error())
+			return
+		}
+		statusCode = 200
+	}
+	if s.requestRecorder != nil {
+		body, _ := BodyFromContext(r.Context())
+		defer func() { s.requestRecorder(method, body, statusCode) }()
+	}
+	if s.polymorphicTypes != nil {
+		r = r.WithContext(context.WithValue(r.Context(), polymorphicTypesKey, s.polymorphicTypes))
+	}
+	if s.strictTrailingData {
+		r = r.WithContext(context.WithValue(r.Context(), strictTrailingDataKey, true))
+	}
+	if s.maxDecodeDepth > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), maxDecodeDepthKey, s.maxDecodeDepth))
+	}
+	if s.prettyJSON != nil && s.prettyJSON(r) {
+		r = r.WithContext(context.WithValue(r.Context(), prettyJSONKey, true))
+	}
+	if bc, ok := codec.(BatchCodec); ok {
+		if s.maxBatchSize > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), maxBatchSizeKey, s.maxBatchSize))
+		}
+		codecReqs, errBatch := bc.NewBatchRequest(r)
+		if errBatch != nil {
+			failure = errBatch
+			statusCode = writeBatchError(w, bc, readErrorStatus(r, errBatch), errBatch)
+			return
+		}
+		if codecReqs != nil {
+			if s.batchConcurrency != nil {
+				release, ok := s.acquireBatch(r)
+				if !ok {
+					failure = errTooManyBatches
+					statusCode = writeBatchError(w, bc, 503, failure)
+					return
+				}
+				defer release()
+			}
+			batched = true
+			s.serveBatch(w, r, codecReqs, match)
+			return
+		}
+	}
 	codecReq := codec.NewRequest(r)
+	if rc != nil {
+		codecReq = &negotiatedRequest{CodecRequest: codecReq, response: rc.NewResponse(r)}
+	}
+	served = s.serveRequest(w, r, start, codecReq, match)
+	method, statusCode = served.Method, served.StatusCode
+}
+
+// serveRequest serves a codec request started at start, returning its info,
+// with the method, the status code of the response and the error the
+// request failed with, if any. The info is the one passed to the interrupt
+// funcs and stored in the request context.
+func (s *Server) serveRequest(w http.ResponseWriter, r *http.Request, start time.Time, codecReq CodecRequest, match codecMatch) (info *RequestInfo) {
+	statusCode := 200
+	var errResult error
+	var failure error        // error the request was rejected with, if any
+	var pooled *pooledValues // args and reply to return to the pool, if any
+	known := false           // whether the method is registered
 	// Get service method to be called.
 	method, errMethod := codecReq.Method()
+	if nc, ok := codecReq.(NotificationCodecRequest); ok && nc.IsNotification() {
+		defer w.WriteHeader(http.StatusNoContent)
+		w = &notificationWriter{header: make(http.Header)}
+	}
+	if s.methodPrefix != "" {
+		method = strings.TrimPrefix(method, s.methodPrefix)
+	}
+	// The settings of the methods are keyed by their canonical name.
+	method = s.services.canonical(method)
+	info = &RequestInfo{
+		Method:       method,
+		RequestID:    CorrelationIDFromContext(r.Context()),
+		ContentType:  match.contentType,
+		ResponseType: match.responseType,
+	}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+	info.Request = r
+	defer func() {
+		if failure == nil {
+			failure = errResult
+		}
+		info.StatusCode, info.Error = statusCode, failure
+		if s.metrics != nil {
+			label := UnknownMethodLabel
+			if known {
+				label = method
+			}
+			s.metrics.observe(label, statusCode, failure, time.Since(start))
+		}
+		if failure != nil {
+			s.logFailure(r, method, statusCode, failure)
+		}
+		if pooled != nil {
+			pooled.release()
+		}
+	}()
+	var args reflect.Value
+	r, span := s.startRequestSpan(r, method)
+	defer func() { endRequestSpan(span, statusCode, errResult) }()
 
-	if s.interruptFunc != nil {
-		interrupt := s.interruptFunc(&RequestInfo{
-			Request: r,
-			Method:  method,
-		})
-		if interrupt.Error != nil {
-			codecReq.WriteError(w, interrupt.StatusCode, interrupt.Error, nil)
-			return
+	if len(s.interruptFuncs) > 0 {
+		for _, interruptFunc := range s.interruptFuncs {
+			interrupt := interruptFunc(info)
+			if interrupt != nil && (interrupt.Error != nil || interrupt.Response != nil) {
+				mergeResponseHeader(w, interrupt.Headers)
+			}
+			if interrupt != nil && interrupt.Error != nil {
+				failure = interrupt.Error
+				statusCode = writeStatusError(w, r, codecReq, interrupt.StatusCode, interrupt.Error, nil)
+				return
+			}
+			if interrupt != nil && interrupt.Response != nil {
+				statusCode, failure = s.writeInterruptResponse(w, r, codecReq, interrupt)
+				return
+			}
 		}
 	}
 
 	// method
 	if errMethod != nil {
-		statusCode = 400
-		codecReq.WriteError(w, statusCode, errMethod, nil)
+		span.RecordError(errMethod)
+		failure = errMethod
+		statusCode = s.writeMethodError(w, r, codecReq, errMethod, nil)
 		return
 	}
-	serviceSpec, methodSpec, errGet := s.services.get(method)
-	if errGet != nil {
+	if s.maxMethodLen > 0 && len(method) > s.maxMethodLen {
 		statusCode = 400
-		codecReq.WriteError(w, statusCode, errGet, nil)
+		failure = fmt.Errorf("rpc: method name longer than %d bytes", s.maxMethodLen)
+		codecReq.WriteError(w, statusCode, failure, nil)
 		return
 	}
-	// Decode the args.
-	args = reflect.New(methodSpec.argsType)
-	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-		statusCode = 400
-		codecReq.WriteError(w, statusCode, errRead, nil)
+	if (r.Method == "HEAD" || r.Method == "GET") && !s.readOnlyMethods[method] {
+		statusCode = 405
+		failure = errors.New("rpc: POST method required, received " + r.Method)
+		WriteError(w, statusCode, failure.Error())
 		return
 	}
-	// Call the service method.
-	reply := reflect.New(methodSpec.replyType)
-	errValue := methodSpec.method.Func.Call([]reflect.Value{
-		serviceSpec.rcvr,
-		reflect.ValueOf(r),
-		args,
-		reply,
-	})
-	// Call the registered Intercept Function
+	// Call the registered Intercept Function, for unknown methods too.
+	var reply reflect.Value
+	var cacheKey string
+	var cacheHit bool
 	defer func() { // call instrument func with method
 		duration := time.Since(start)
-		if s.instrumentFunc != nil {
-			s.instrumentFunc(&InstrumentInfo{Method: method, Duration: duration, StatusCode: statusCode, Error: errResult, Args: args, Reply: reply, Request: r})
+		if s.latency != nil && known {
+			s.latency.observe(method, duration)
+		}
+		if len(s.instrumentFuncs) > 0 {
+			info := &InstrumentInfo{Method: method, Duration: duration, StatusCode: statusCode, Error: errResult, Args: args, Request: r,
+				CacheKey: cacheKey, CacheHit: cacheHit, RequestID: CorrelationIDFromContext(r.Context()),
+				ContentType: match.contentType, ResponseType: match.responseType}
+			if info.Error == nil {
+				info.Error = failure
+			}
+			if reply.IsValid() {
+				info.Reply = reply
+			}
+			for _, instrumentFunc := range s.instrumentFuncs {
+				instrumentFunc(info)
+			}
 		}
 	}()
-	// Cast the result to error if needed.
-	errInter := errValue[0].Interface()
-	if errInter != nil {
-		errResult = errInter.(error)
+	serviceSpec, methodSpec, errGet := s.services.lookup(method)
+	if errGet != nil {
+		notFound := errors.Is(errGet, ErrServiceNotFound) || errors.Is(errGet, ErrMethodNotFound)
+		if notFound && s.fallbackHandler != nil {
+			statusCode = s.serveFallback(w, r, codecReq, method)
+			return
+		}
+		span.RecordError(errGet)
+		failure = errGet
+		statusCode = 400
+		if notFound {
+			statusCode = 404
+			if s.notFoundHandler != nil {
+				statusCode = s.serveNotFound(w, r, codecReq, method)
+				return
+			}
+		}
+		codecReq.WriteError(w, statusCode, errGet, nil)
+		return
+	}
+	known = true
+	r = r.WithContext(context.WithValue(r.Context(), methodKey, method))
+	if d, ok := s.deprecations[method]; ok {
+		d.setHeaders(w.Header())
+	}
+	// Decode the args. Methods without args don't need a body.
+	decodeStart := time.Now()
+	var newReply reflect.Value
+	if s.canPool(method, methodSpec) {
+		pooled = methodSpec.getValues()
+		args, newReply = pooled.args, pooled.reply
+	} else {
+		args, newReply = methodSpec.newValues()
+	}
+	_, decodeSpan := s.startSpan(r, "decode")
+	if !methodSpec.noArgs {
+		if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
+			endSpan(decodeSpan, errRead)
+			span.RecordError(errRead)
+			failure = errRead
+			statusCode = s.writeMethodError(w, r, codecReq, errRead, nil)
+			return
+		}
+		if v, ok := args.Interface().(Validator); ok {
+			if errValid := v.Validate(); errValid != nil {
+				endSpan(decodeSpan, errValid)
+				failure = errValid
+				statusCode = s.writeMethodError(w, r, codecReq, errValid, nil)
+				return
+			}
+		}
+	}
+	decodeSpan.End()
+	if s.readTimeout > 0 {
+		clearReadDeadline(r)
 	}
 	// Prevents Internet Explorer from MIME-sniffing a response away
 	// from the declared content-type
 	w.Header().Set("x-content-type-options", "nosniff")
+	hr, handlerSpan := s.startSpan(r, "handler")
+	if methodSpec.stream {
+		statusCode, errResult = s.serveStream(w, hr, codecReq, serviceSpec, methodSpec, args)
+		endSpan(handlerSpan, errResult)
+		return
+	}
+	var lastModified time.Time
+	var successStatus int
+	var header http.Header
+	ctx := context.WithValue(context.WithValue(hr.Context(), lastModifiedKey, &lastModified), successStatusKey, &successStatus)
+	hr = hr.WithContext(context.WithValue(ctx, responseHeaderKey, &header))
+	// Call the service method, unless the reply is cached.
+	cache := s.methodCaches[method]
+	if cache != nil {
+		if key, ok := methodCacheKey(method, args); ok {
+			cacheKey = key
+			reply, cacheHit = cache.get(key)
+		}
+	}
+	callStart := time.Now()
+	if !cacheHit {
+		reply = newReply
+		if s.requestTimeout > 0 {
+			errResult = s.callWithTimeout(hr, method, serviceSpec, methodSpec, args, reply)
+		} else {
+			errResult = s.callPooled(hr, method, serviceSpec, methodSpec, args, reply)
+		}
+		if errResult == ErrWorkerPoolFull {
+			endSpan(handlerSpan, errResult)
+			statusCode = writeStatusError(w, r, codecReq, 503, errResult, nil)
+			return
+		}
+		if errResult == nil && cacheKey != "" {
+			cache.put(cacheKey, reply)
+		}
+	}
+	endSpan(handlerSpan, errResult)
+	// A method timing out may still be running and setting its header.
+	abandoned := s.requestTimeout > 0 && errResult != nil && hr.Context().Err() != nil
+	if !abandoned && header != nil {
+		mergeResponseHeader(w, header)
+	}
+	if s.serverTiming {
+		w.Header().Set("Server-Timing", fmt.Sprintf("decode;dur=%s, handler;dur=%s",
+			formatMillis(callStart.Sub(decodeStart)), formatMillis(time.Since(callStart))))
+	}
 	// Encode the response.
-	if errResult == nil {
-		codecReq.WriteResponse(w, reply.Interface())
+	_, encodeSpan := s.startSpan(r, "encode")
+	if errResult != nil {
+		statusCode = s.writeMethodError(w, r, codecReq, errResult, reply.Interface())
+	} else if !lastModified.IsZero() && checkNotModified(w, r, lastModified) {
+		statusCode = 304
+		w.WriteHeader(statusCode)
+	} else if status := s.successStatusFor(method, successStatus); status == http.StatusNoContent {
+		statusCode = status
+		w.WriteHeader(statusCode)
 	} else {
-		statusCode = 400
-		codecReq.WriteError(w, statusCode, errResult, reply.Interface())
+		rw := w
+		var sw *statusWriter
+		if status != 0 {
+			statusCode = status
+			sw = &statusWriter{ResponseWriter: w, status: status}
+			rw = sw
+		}
+		if errWrite := writeResponse(rw, codecReq, s.filterReply(r, reply.Interface())); errWrite != nil {
+			// The status may be sent already, so it is unknown.
+			statusCode, errResult = 0, errWrite
+		} else if sw != nil && sw.written != 0 {
+			statusCode = sw.written
+		}
+	}
+	encodeSpan.End()
+	return
+}
+
+// writeInterruptResponse writes the response set by an interrupt func and
+// returns the status code of the response, or 0 and the error if it could
+// not be written.
+func (s *Server) writeInterruptResponse(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, interrupt *InterruptInfo) (int, error) {
+	status := interrupt.StatusCode
+	if status == 0 {
+		status = 200
+	}
+	sw := &statusWriter{ResponseWriter: w, status: status}
+	if err := writeResponse(sw, codecReq, s.filterReply(r, interrupt.Response)); err != nil {
+		return 0, err
+	}
+	if sw.written != 0 {
+		status = sw.written
+	}
+	return status, nil
+}
+
+// codecFor returns the codec for the request and the media type of its
+// Content-Type header, or a nil codec if none matches. GET requests get a
+// codec reading the query string.
+func (s *Server) codecFor(r *http.Request) (string, Codec) {
+	if r.Method != "GET" {
+		return s.contentTypeCodec(r)
+	}
+	if s.queryCodec != nil {
+		return "", s.queryCodec
+	}
+	contentType, codec := s.contentTypeCodec(r)
+	if qc, ok := codec.(QueryCodec); ok {
+		return contentType, fromQueryCodec{qc}
+	}
+	return contentType, nil
+}
+
+// contentTypeCodec returns the codec for the Content-Type of the request
+// and its media type, the one of the single codec if chosen by default.
+func (s *Server) contentTypeCodec(r *http.Request) (string, Codec) {
+	contentType := r.Header.Get("Content-Type")
+	if s.singleCodec != nil && s.allowedTypes == nil {
+		// Skip parsing the header in the common single codec configuration.
+		if s.singleCodecFast || contentType == "" || contentType == s.singleContentType {
+			return s.singleContentType, s.singleCodec
+		}
+	}
+	idx := strings.Index(contentType, ";")
+	if idx != -1 {
+		contentType = contentType[:idx]
+	}
+	key := strings.ToLower(contentType)
+	if s.allowedTypes != nil && !s.allowedTypes[key] {
+		return contentType, nil
+	}
+	return contentType, s.codecs[key]
+}
+
+// formatMillis formats a duration in milliseconds for a Server-Timing header.
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+}
+
+// writeResponse writes a reply, returning the error of the codec or the
+// writer, if any.
+func writeResponse(w http.ResponseWriter, codecReq CodecRequest, reply interface{}) error {
+	ew := &errorWriter{ResponseWriter: w}
+	var err error
+	if cr, ok := codecReq.(CheckedCodecRequest); ok {
+		err = cr.WriteResponseChecked(ew, reply)
+	} else {
+		codecReq.WriteResponse(ew, reply)
+	}
+	if err == nil {
+		err = ew.err
+	}
+	return err
+}
+
+// errorWriter records the first error writing a response.
+type errorWriter struct {
+	http.ResponseWriter
+	err error
+}
+
+func (w *errorWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *errorWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// writeMethodError writes an error returned by a service method, or reading
+// the request, and returns the status code of the response. Bodies over the
+// limit set by SetMaxBodyBytes get a 413, bodies not read in time a 408, and
+// an *Error the status mapped from its code.
+func (s *Server) writeMethodError(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, err error, reply interface{}) int {
+	status := readErrorStatus(r, err)
+	var rpcErr *Error
+	if status == 400 && errors.As(err, &rpcErr) {
+		if s.errorStatus != nil {
+			status = s.errorStatus(rpcErr.Code)
+		} else {
+			status = DefaultErrorStatus(rpcErr.Code)
+		}
+	}
+	return writeStatusError(w, r, codecReq, status, err, reply)
+}
+
+// writeStatusError writes an error with the given status, unless it is a
+// context error, and returns the status code of the response. Interrupt and
+// method errors share it so they are encoded alike.
+func writeStatusError(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, status int, err error, reply interface{}) int {
+	if s, ok := contextErrorStatus(err); !ok {
+		if status == 0 {
+			status = 400
+		}
+	} else if status = s; errors.Is(r.Context().Err(), context.Canceled) {
+		// Don't bother writing a body if the client has already gone away.
+		w.WriteHeader(status)
+		return status
+	}
+	setRetryAfter(w, err)
+	// Report the status written by the codec, which may not be the one
+	// asked for.
+	sw := &statusWriter{ResponseWriter: w, status: 200}
+	codecReq.WriteError(sw, status, err, reply)
+	if sw.written != 0 {
+		status = sw.written
+	}
+	return status
+}
+
+// StatusClientClosedRequest is the non-standard status code used when the
+// client closed the connection before the handler completed.
+const StatusClientClosedRequest = 499
+
+// contextErrorStatus maps context errors returned by a handler to a status
+// code: 499 for context.Canceled and 504 for context.DeadlineExceeded.
+func contextErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, true
 	}
+	return 0, false
 }
 
 func WriteError(w http.ResponseWriter, status int, msg string) {
@@ -6,9 +6,24 @@
 package rpc
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime/pprof"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,9 +45,124 @@ func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1
 	return nil
 }
 
+func (t *Service1) Add(req *Service1Request, res *Service1Response) error {
+	res.Result = req.A + req.B
+	return nil
+}
+
 type Service2 struct {
 }
 
+// Service3 has methods exercising the less common dispatch paths.
+type Service3 struct {
+}
+
+// Context writes the context values set by the server to the error.
+func (t *Service3) Context(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return errors.New(CorrelationIDFromContext(r.Context()))
+}
+
+// Err returns the error named by the A field of the request.
+func (t *Service3) Err(r *http.Request, req *Service1Request, res *Service1Response) error {
+	switch req.A {
+	case 1:
+		return context.Canceled
+	case 2:
+		return context.DeadlineExceeded
+	}
+	return errors.New("service3 error")
+}
+
+// Method writes the method name seen in the request context to the error.
+func (t *Service3) Method(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return errors.New(MethodFromContext(r.Context()))
+}
+
+// Pair returns the product and the sum of A and B.
+func (t *Service3) Pair(r *http.Request, req *Service1Request) (int, string, error) {
+	if req.A < 0 {
+		return 0, "", errors.New("negative")
+	}
+	return req.A * req.B, strconv.Itoa(req.A + req.B), nil
+}
+
+// Modified returns A and sets it as the modification time of the reply.
+func (t *Service3) Modified(r *http.Request, req *Service1Request, res *Service1Response) error {
+	SetLastModified(r.Context(), time.Unix(int64(req.A), 0))
+	res.Result = req.A
+	return nil
+}
+
+// Label writes the method pprof label to the error.
+func (t *Service3) Label(r *http.Request, req *Service1Request, res *Service1Response) error {
+	label, _ := pprof.Label(r.Context(), PprofMethodLabel)
+	return errors.New(label)
+}
+
+// Product returns the product of A and B, or no reply if A is zero.
+func (t *Service3) Product(r *http.Request, req *Service1Request) (*Service1Response, error) {
+	if req.A == 0 {
+		return nil, nil
+	}
+	return &Service1Response{Result: req.A * req.B}, nil
+}
+
+// Deadline takes a context, failing unless it has a deadline.
+func (t *Service3) Deadline(ctx context.Context, req *Service1Request, res *Service1Response) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("no deadline")
+	}
+	res.Result = req.A * req.B
+	return nil
+}
+
+// Ping takes no args.
+func (t *Service3) Ping(r *http.Request, req *struct{}, res *Service1Response) error {
+	res.Result = 1
+	return nil
+}
+
+// Service4 has streaming methods.
+type Service4 struct {
+	// stopped is closed when Forever returns.
+	stopped chan struct{}
+}
+
+// Count sends the integers from A to B, failing at the end if A is negative.
+func (t *Service4) Count(r *http.Request, req *Service1Request, res chan<- Service1Response) error {
+	for i := req.A; i < req.B; i++ {
+		res <- Service1Response{i}
+	}
+	if req.A < 0 {
+		return errors.New("negative start")
+	}
+	return nil
+}
+
+// Forever sends integers until the request context is done.
+func (t *Service4) Forever(r *http.Request, req *Service1Request, res chan<- Service1Response) error {
+	defer close(t.stopped)
+	for i := 0; ; i++ {
+		select {
+		case res <- Service1Response{i}:
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// Panic panics after sending a value.
+func (t *Service4) Panic(r *http.Request, req *Service1Request, res chan<- Service1Response) error {
+	res <- Service1Response{1}
+	panic("boom")
+}
+
+// Func sends a value that can't be encoded.
+func (t *Service4) Func(r *http.Request, req *Service1Request, res chan<- func()) error {
+	res <- func() {}
+	return nil
+}
+
 func TestRegisterService(t *testing.T) {
 	var err error
 	s := NewServer()
@@ -90,9 +220,14 @@ func (r MockCodecRequest) WriteError(w http.ResponseWriter, status int, err erro
 }
 
 type MockResponseWriter struct {
-	header http.Header
-	Status int
-	Body   string
+	header  http.Header
+	Status  int
+	Body    string
+	Flushes int
+	// OnFlush is called after each flush when set.
+	OnFlush func()
+	// WriteErr is returned by Write when set.
+	WriteErr error
 }
 
 func NewMockResponseWriter() *MockResponseWriter {
@@ -105,7 +240,10 @@ func (w *MockResponseWriter) Header() http.Header {
 }
 
 func (w *MockResponseWriter) Write(p []byte) (int, error) {
-	w.Body = string(p)
+	if w.WriteErr != nil {
+		return 0, w.WriteErr
+	}
+	w.Body += string(p)
 	if w.Status == 0 {
 		w.Status = 200
 	}
@@ -116,6 +254,132 @@ func (w *MockResponseWriter) WriteHeader(status int) {
 	w.Status = status
 }
 
+func (w *MockResponseWriter) Flush() {
+	w.Flushes++
+	if w.OnFlush != nil {
+		w.OnFlush()
+	}
+}
+
+// MockTextCodec decodes requests as MockCodec and writes the responses
+// as formatted by fmt, also for requests decoded by other codecs.
+type MockTextCodec struct {
+	MockCodec
+}
+
+func (c MockTextCodec) ContentTypes() []string {
+	return []string{"text/plain"}
+}
+
+func (c MockTextCodec) NewResponse(r *http.Request) ResponseEncoder {
+	return MockTextResponse{}
+}
+
+type MockTextResponse struct{}
+
+func (MockTextResponse) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%+v", reply)
+}
+
+func (MockTextResponse) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "error: %v", err)
+}
+
+// MockJSONCodec reads the method from the "method" query parameter and the
+// args from a JSON body, using Decode when set. Streams are written as
+// {"result":[...],"error":...} unless NoStream is set.
+type MockJSONCodec struct {
+	Decode   func(body io.Reader, args interface{}) error
+	NoStream bool
+}
+
+func (c MockJSONCodec) NewRequest(r *http.Request) CodecRequest {
+	req := &MockJSONCodecRequest{codec: c, r: r}
+	if c.NoStream {
+		// Hide the StreamingCodecRequest methods.
+		return struct{ CodecRequest }{req}
+	}
+	return req
+}
+
+type MockJSONCodecRequest struct {
+	codec    MockJSONCodec
+	r        *http.Request
+	streamed bool
+}
+
+func (c *MockJSONCodecRequest) Method() (string, error) {
+	if method := c.r.URL.Query().Get("method"); method != "" {
+		return method, nil
+	}
+	return "", errors.New("missing method")
+}
+
+func (c *MockJSONCodecRequest) ReadRequest(args interface{}) error {
+	if c.codec.Decode != nil {
+		return c.codec.Decode(c.r.Body, args)
+	}
+	return json.NewDecoder(c.r.Body).Decode(args)
+}
+
+func (c *MockJSONCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (c *MockJSONCodecRequest) WriteError(w http.ResponseWriter, status int, err error, reply interface{}) {
+	w.WriteHeader(status)
+	w.Write([]byte(err.Error()))
+}
+
+func (c *MockJSONCodecRequest) WriteStreamStart(w http.ResponseWriter) error {
+	_, err := w.Write([]byte(`{"result":[`))
+	return err
+}
+
+func (c *MockJSONCodecRequest) WriteStreamValue(w http.ResponseWriter, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if c.streamed {
+		w.Write([]byte(","))
+	}
+	c.streamed = true
+	_, err = w.Write(b)
+	return err
+}
+
+func (c *MockJSONCodecRequest) WriteStreamEnd(w http.ResponseWriter, err error) error {
+	var errValue interface{}
+	if err != nil {
+		errValue = err.Error()
+	}
+	b, _ := json.Marshal(errValue)
+	_, err = w.Write([]byte(`],"error":` + string(b) + "}"))
+	return err
+}
+
+// newMockJSONServer returns a server with Service1 and Service3 registered
+// using the MockJSONCodec.
+func newMockJSONServer() *Server {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Service3), "")
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+	return s
+}
+
+// newMockJSONRequest returns a POST request calling method with a JSON body.
+func newMockJSONRequest(method, body string) *http.Request {
+	r := httptest.NewRequest("POST", "/?method="+method, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
 func TestServeHTTP(t *testing.T) {
 	const (
 		A = 2
@@ -229,3 +493,2984 @@ func TestInstrumentFunc(t *testing.T) {
 		t.Error("Code should be 200")
 	}
 }
+
+func TestContextErrorStatus(t *testing.T) {
+	s := newMockJSONServer()
+	var statusCode int
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		statusCode = i.StatusCode
+	})
+
+	// The client went away: 499 and no body.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.err", `{"A":1}`).WithContext(ctx))
+	if w.Status != StatusClientClosedRequest || statusCode != StatusClientClosedRequest {
+		t.Errorf("Status was %d (instrumented %d), should be %d.", w.Status, statusCode, StatusClientClosedRequest)
+	}
+	if w.Body != "" {
+		t.Errorf("Response body was %q, should be empty.", w.Body)
+	}
+
+	// The handler timed out on its own: 504 with the error body.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.err", `{"A":2}`))
+	if w.Status != 504 || statusCode != 504 {
+		t.Errorf("Status was %d (instrumented %d), should be 504.", w.Status, statusCode)
+	}
+	if w.Body != context.DeadlineExceeded.Error() {
+		t.Errorf("Response body was %q, should be %q.", w.Body, context.DeadlineExceeded.Error())
+	}
+
+	// Other errors still map to 400.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.err", `{"A":3}`))
+	if w.Status != 400 || statusCode != 400 {
+		t.Errorf("Status was %d (instrumented %d), should be 400.", w.Status, statusCode)
+	}
+}
+
+func TestErrorHelpers(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{NewError(409, "conflict"), 409},
+		{BadRequest("bad"), 400},
+		{NotFound("missing"), 404},
+		{Unauthorized("denied"), 401},
+		{Internal("broken"), 500},
+	}
+	for _, tt := range tests {
+		s := newMockJSONServer()
+		s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+			return tt.err
+		})
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":1,"B":2}`))
+		if w.Status != tt.status {
+			t.Errorf("Status of %q was %d, should be %d.", tt.err, w.Status, tt.status)
+		}
+		// Codecs only using the message of the error still encode it.
+		if w.Body != tt.err.Error() {
+			t.Errorf("Response body was %q, should be %q.", w.Body, tt.err.Error())
+		}
+	}
+}
+
+// strictDecode decodes the args rejecting unknown fields.
+func strictDecode(body io.Reader, args interface{}) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(args)
+}
+
+// legacyDecode decodes a Service1Request from its former {"Left", "Right"}
+// shape.
+func legacyDecode(body io.Reader, args interface{}) error {
+	var legacy struct{ Left, Right int }
+	if err := json.NewDecoder(body).Decode(&legacy); err != nil {
+		return err
+	}
+	req := args.(*Service1Request)
+	req.A, req.B = legacy.Left, legacy.Right
+	return nil
+}
+
+func TestRegisterFallbackCodec(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockJSONCodec{Decode: strictDecode}, "application/json")
+	s.RegisterFallbackCodec(MockJSONCodec{Decode: legacyDecode}, "application/json")
+
+	for _, body := range []string{`{"A":4,"B":2}`, `{"Left":4,"Right":2}`} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", body))
+		if w.Status != 200 {
+			t.Errorf("Status was %d, should be 200.", w.Status)
+		}
+		if got := strings.TrimSpace(w.Body); got != `{"Result":8}` {
+			t.Errorf("Response body was %s, should be {\"Result\":8}.", got)
+		}
+	}
+
+	// When every codec fails the error of the primary one is reported.
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `[1]`))
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+	if want := "json: cannot unmarshal array into Go value of type rpc.Service1Request"; w.Body != want {
+		t.Errorf("Response body was %q, should be %q.", w.Body, want)
+	}
+
+	// Bodies too large to be buffered are rejected.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", strings.Repeat(" ", maxBufferedBodyBytes+1)))
+	if w.Status != 413 {
+		t.Errorf("Status was %d, should be 413.", w.Status)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service4), "")
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service4.count", `{"A":1,"B":4}`))
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if want := `{"result":[{"Result":1},{"Result":2},{"Result":3}],"error":null}`; w.Body != want {
+		t.Errorf("Response body was %s, should be %s.", w.Body, want)
+	}
+	if w.Flushes < 3 {
+		t.Errorf("Response was flushed %d times, should be at least 3.", w.Flushes)
+	}
+
+	// An error after some values ends the stream.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service4.count", `{"A":-1,"B":1}`))
+	if want := `{"result":[{"Result":-1},{"Result":0}],"error":"negative start"}`; w.Body != want {
+		t.Errorf("Response body was %s, should be %s.", w.Body, want)
+	}
+
+	// An error before any value goes through the codec.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service4.count", `{"A":-1,"B":-1}`))
+	if w.Status != 400 || w.Body != "negative start" {
+		t.Errorf("Response was %d %q, should be 400 %q.", w.Status, w.Body, "negative start")
+	}
+
+	// A panic is reported as an error.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service4.panic", `{}`))
+	if want := `{"result":[{"Result":1}],"error":"rpc: panic serving Panic: boom"}`; w.Body != want {
+		t.Errorf("Response body was %s, should be %s.", w.Body, want)
+	}
+
+	// Encoding failures are reported as well.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service4.func", `{}`))
+	if want := `{"result":[],"error":"json: unsupported type: func()"}`; w.Body != want {
+		t.Errorf("Response body was %s, should be %s.", w.Body, want)
+	}
+}
+
+func TestStreamClientGone(t *testing.T) {
+	service := &Service4{stopped: make(chan struct{})}
+	s := NewServer()
+	s.RegisterService(service, "")
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+	var errResult error
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		errResult = i.Error
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewMockResponseWriter()
+	w.OnFlush = func() {
+		if w.Flushes == 2 {
+			cancel()
+		}
+	}
+	s.ServeHTTP(w, newMockJSONRequest("Service4.forever", `{}`).WithContext(ctx))
+	select {
+	case <-service.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Streaming method should stop once the client is gone.")
+	}
+	if errResult != context.Canceled {
+		t.Errorf("Error was %v, should be %v.", errResult, context.Canceled)
+	}
+}
+
+func TestStreamWithoutStreamingCodec(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service4), "")
+	s.RegisterCodec(MockJSONCodec{NoStream: true}, "application/json")
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service4.count", `{"A":1,"B":3}`))
+	if want := `[{"Result":1},{"Result":2}]`; strings.TrimSpace(w.Body) != want {
+		t.Errorf("Response body was %s, should be %s.", w.Body, want)
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service4.count", `{"A":-1,"B":1}`))
+	if w.Status != 400 || w.Body != "negative start" {
+		t.Errorf("Response was %d %q, should be 400 %q.", w.Status, w.Body, "negative start")
+	}
+}
+
+func TestSetMaxMethodNameLength(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetMaxMethodNameLength(len("Service1.multiply"))
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":3}`))
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply"+strings.Repeat("x", 100), `{"A":2,"B":3}`))
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+	if want := "rpc: method name longer than 17 bytes"; w.Body != want {
+		t.Errorf("Response body was %q, should be %q.", w.Body, want)
+	}
+}
+
+func TestSetCorrelationHeaders(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetCorrelationHeaders("X-Request-ID", "X-Correlation-ID", "traceparent")
+
+	for _, test := range []struct {
+		header, value, id string
+	}{
+		{"X-Request-ID", "req-1", "req-1"},
+		{"X-Correlation-ID", "corr-1", "corr-1"},
+		{"Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+	} {
+		r := newMockJSONRequest("Service3.context", `{}`)
+		r.Header.Set(test.header, test.value)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != test.id {
+			t.Errorf("Correlation id was %q, should be %q.", w.Body, test.id)
+		}
+		if got := w.Header().Get(test.header); got != test.value {
+			t.Errorf("Header %s was %q, should be %q.", test.header, got, test.value)
+		}
+	}
+
+	// The first header wins.
+	r := newMockJSONRequest("Service3.context", `{}`)
+	r.Header.Set("X-Correlation-ID", "corr-1")
+	r.Header.Set("X-Request-ID", "req-1")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Body != "req-1" {
+		t.Errorf("Correlation id was %q, should be %q.", w.Body, "req-1")
+	}
+
+	// An id is generated when no header is present.
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.context", `{}`))
+	if len(w.Body) != 32 {
+		t.Errorf("Correlation id was %q, should be 32 hex digits.", w.Body)
+	}
+	if got := w.Header().Get("X-Request-ID"); got != w.Body {
+		t.Errorf("Header X-Request-ID was %q, should be %q.", got, w.Body)
+	}
+}
+
+func TestSetSingleCodecFastPath(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.SetSingleCodecFastPath(true)
+
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "invalid")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 || w.Body != "6" {
+		t.Errorf("Response was %d %q, should be 200 \"6\".", w.Status, w.Body)
+	}
+
+	// The fast path is dropped as soon as another codec is registered.
+	s.RegisterCodec(MockCodec{2, 3}, "other")
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 415 {
+		t.Errorf("Status was %d, should be 415.", w.Status)
+	}
+}
+
+func benchmarkCodecSelection(b *testing.B, contentTypes ...string) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	for _, contentType := range contentTypes {
+		s.RegisterCodec(MockCodec{2, 3}, contentType)
+	}
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "application/json")
+	w := NewMockResponseWriter()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Body = ""
+		s.ServeHTTP(w, r)
+	}
+}
+
+func BenchmarkSingleCodec(b *testing.B) {
+	benchmarkCodecSelection(b, "application/json")
+}
+
+func BenchmarkMultipleCodecs(b *testing.B) {
+	benchmarkCodecSelection(b, "application/json", "application/xml")
+}
+
+func TestMethodNotFound(t *testing.T) {
+	s := newMockJSONServer()
+
+	for _, test := range []struct {
+		method string
+		status int
+		body   string
+		kind   error
+	}{
+		{"Service1.divide", 404, `rpc: unknown method "divide" on service "Service1"`, ErrMethodNotFound},
+		{"Service9.multiply", 404, `rpc: can't find service "Service9.multiply"; did you mean "Service1.multiply"?`, ErrServiceNotFound},
+		{"Service1.multiplu", 404, `rpc: unknown method "multiplu" on service "Service1"; did you mean "Service1.multiply"?`, ErrMethodNotFound},
+		{"Other.multiply", 404, `rpc: can't find service "Other.multiply"`, ErrServiceNotFound},
+		{"Service1", 400, `rpc: service/method request ill-formed: "Service1"`, nil},
+		{"Service1.bogus", 404, `rpc: unknown method "bogus" on service "Service1"`, ErrMethodNotFound},
+	} {
+		var instrumented *InstrumentInfo
+		s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+			instrumented = i
+		})
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, `{}`))
+		if w.Status != test.status || w.Body != test.body {
+			t.Errorf("Response was %d %q, should be %d %q.", w.Status, w.Body, test.status, test.body)
+		}
+		if instrumented == nil || instrumented.StatusCode != test.status || instrumented.Error == nil {
+			t.Errorf("Instrumented info was %+v, should have %d and the error.", instrumented, test.status)
+		}
+		if _, _, err := s.services.get(test.method); test.kind != nil && !errors.Is(err, test.kind) {
+			t.Errorf("Error %q should match %q.", err, test.kind)
+		}
+	}
+}
+
+func TestReplaceMethod(t *testing.T) {
+	s := newMockJSONServer()
+
+	add := func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		res.Result = req.A + req.B
+		return nil
+	}
+	if err := s.ReplaceMethod("Service1.multiply", add); err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if expected := "{\"Result\":7}\n"; w.Status != 200 || w.Body != expected {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, expected)
+	}
+
+	// Replacing while serving must be safe.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.ReplaceMethod("Service1.multiply", add)
+	}
+	<-done
+
+	for _, fn := range []interface{}{
+		nil,
+		"add",
+		func(r *http.Request, req *Service1Request, res *Service1Response) {},
+		func(r *http.Request, req *Service1Response, res *Service1Response) error { return nil },
+	} {
+		if err := s.ReplaceMethod("Service1.multiply", fn); err == nil {
+			t.Errorf("Expected an error replacing the method with %T.", fn)
+		}
+	}
+	if err := s.ReplaceMethod("Service1.divide", add); !errors.Is(err, ErrMethodNotFound) {
+		t.Errorf("Error was %v, should match %v.", err, ErrMethodNotFound)
+	}
+}
+
+func TestSetServerTiming(t *testing.T) {
+	s := newMockJSONServer()
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if timing := w.Header().Get("Server-Timing"); timing != "" {
+		t.Errorf("Server-Timing was %q, should be unset.", timing)
+	}
+
+	s.SetServerTiming(true)
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	timing := w.Header().Get("Server-Timing")
+	var decode, handler float64
+	if n, err := fmt.Sscanf(timing, "decode;dur=%g, handler;dur=%g", &decode, &handler); n != 2 || err != nil {
+		t.Errorf("Server-Timing was %q, should be %q.", timing, "decode;dur=<ms>, handler;dur=<ms>")
+	}
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+// transientError is a retryable error.
+type transientError struct{}
+
+func (transientError) Error() string   { return "transient" }
+func (transientError) Retryable() bool { return true }
+
+func TestSetMethodRetry(t *testing.T) {
+	s := newMockJSONServer()
+	calls := 0
+	s.ReplaceMethod("Service3.err", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		calls++
+		res.Result = calls
+		if calls <= req.A {
+			return transientError{}
+		}
+		if calls <= req.B {
+			return errors.New("permanent")
+		}
+		return nil
+	})
+	s.SetMethodRetry("Service3.err", 3, time.Millisecond)
+
+	for _, test := range []struct {
+		body   string
+		calls  int
+		status int
+		resp   string
+	}{
+		// Fails transiently twice, then succeeds.
+		{`{"A":2}`, 3, 200, "{\"Result\":3}\n"},
+		// Fails transiently more times than attempted.
+		{`{"A":3}`, 3, 400, "transient"},
+		// Fails permanently after a transient error.
+		{`{"A":1,"B":2}`, 2, 400, "permanent"},
+	} {
+		calls = 0
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service3.err", test.body))
+		if calls != test.calls || w.Status != test.status || w.Body != test.resp {
+			t.Errorf("%s: response was %d %q after %d calls, should be %d %q after %d calls.",
+				test.body, w.Status, w.Body, calls, test.status, test.resp, test.calls)
+		}
+	}
+}
+
+func TestNoArgs(t *testing.T) {
+	s := newMockJSONServer()
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.ping", ""))
+	if expected := "{\"Result\":1}\n"; w.Status != 200 || w.Body != expected {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, expected)
+	}
+}
+
+func TestSetAllowedContentTypes(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterCodec(MockJSONCodec{}, "text/json")
+	s.SetAllowedContentTypes("Application/JSON")
+
+	for _, test := range []struct {
+		contentType string
+		status      int
+	}{
+		{"application/json", 200},
+		{"application/json; charset=utf-8", 200},
+		{"text/json", 415},
+		{"", 415},
+	} {
+		r := newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)
+		r.Header.Set("Content-Type", test.contentType)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != test.status {
+			t.Errorf("%q: status was %d, should be %d.", test.contentType, w.Status, test.status)
+		}
+	}
+
+	// The restriction also applies to a single codec.
+	s = newMockJSONServer()
+	s.SetSingleCodecFastPath(true)
+	s.SetAllowedContentTypes("application/json")
+	r := newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)
+	r.Header.Set("Content-Type", "text/plain")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 415 {
+		t.Errorf("Status was %d, should be 415.", w.Status)
+	}
+}
+
+func TestSetMethodCache(t *testing.T) {
+	s := newMockJSONServer()
+	calls := 0
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		calls++
+		res.Result = req.A * req.B
+		return nil
+	})
+	s.SetMethodCache("Service1.multiply", time.Minute)
+	var info InstrumentInfo
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		info = *i
+	})
+
+	for _, test := range []struct {
+		body  string
+		calls int
+		hit   bool
+	}{
+		{`{"A":2,"B":5}`, 1, false},
+		{`{"A":2,"B":5}`, 1, true},
+		{`{"A":2,"B":6}`, 2, false},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", test.body))
+		if w.Status != 200 || calls != test.calls {
+			t.Errorf("%s: status was %d after %d calls, should be 200 after %d calls.", test.body, w.Status, calls, test.calls)
+		}
+		if key := "Service1.multiply " + test.body; info.CacheKey != key || info.CacheHit != test.hit {
+			t.Errorf("%s: cache key and hit were %q %v, should be %q %v.", test.body, info.CacheKey, info.CacheHit, key, test.hit)
+		}
+	}
+
+	// Uncached methods report no key.
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service3.ping", ""))
+	if info.CacheKey != "" || info.CacheHit {
+		t.Errorf("Cache key and hit were %q %v, should be unset.", info.CacheKey, info.CacheHit)
+	}
+}
+
+func TestMethodCacheEntries(t *testing.T) {
+	c := newMethodCache(time.Minute, 3)
+	for i := 0; i < 5; i++ {
+		c.put(strconv.Itoa(i), reflect.ValueOf(i))
+	}
+	if len(c.entries) != 3 || c.order.Len() != 3 {
+		t.Errorf("Cache had %d entries, should be bounded to 3.", len(c.entries))
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := c.get(strconv.Itoa(i)); ok != (i >= 2) {
+			t.Errorf("Entry %d was cached: %v, only the last 3 should be.", i, ok)
+		}
+	}
+
+	// Expired entries are dropped when a reply is cached.
+	c = newMethodCache(time.Millisecond, 0)
+	c.put("a", reflect.ValueOf(1))
+	c.put("b", reflect.ValueOf(2))
+	time.Sleep(5 * time.Millisecond)
+	c.put("c", reflect.ValueOf(3))
+	if len(c.entries) != 1 || c.order.Len() != 1 {
+		t.Errorf("Cache had %d entries, should only have the last one.", len(c.entries))
+	}
+
+	// The bound applies to the caches of the server.
+	s := newMockJSONServer()
+	s.SetMethodCacheEntries(2)
+	s.SetMethodCache("Service1.multiply", time.Minute)
+	for _, body := range []string{`{"A":1,"B":5}`, `{"A":2,"B":5}`, `{"A":3,"B":5}`} {
+		s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", body))
+	}
+	if n := len(s.methodCaches["Service1.multiply"].entries); n != 2 {
+		t.Errorf("Cache had %d entries, should be bounded to 2.", n)
+	}
+}
+
+func TestSetRejectUntilReady(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+	s.SetRejectUntilReady(true)
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Status != 503 || w.Body != "rpc: no services registered yet" {
+		t.Errorf("Response was %d %q, should be 503 %q.", w.Status, w.Body, "rpc: no services registered yet")
+	}
+
+	s.RegisterService(new(Service1), "")
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+func TestRegisterBodyHook(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockJSONCodec{Decode: strictDecode}, "application/json")
+	s.RegisterFallbackCodec(MockJSONCodec{Decode: legacyDecode}, "application/json")
+	var seen []string
+	hook := func(r *http.Request, body []byte) error {
+		seen = append(seen, string(body))
+		if string(body) == "{}" {
+			return errors.New("empty args")
+		}
+		return nil
+	}
+	s.RegisterBodyHook(hook)
+	s.RegisterBodyHook(hook)
+
+	body := `{"Left":4,"Right":2}`
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", body))
+	if len(seen) != 2 || seen[0] != body || seen[1] != body {
+		t.Errorf("Hooks saw %q, should both see %q.", seen, body)
+	}
+	if got := strings.TrimSpace(w.Body); w.Status != 200 || got != `{"Result":8}` {
+		t.Errorf("Response was %d %s, should be 200 {\"Result\":8}.", w.Status, got)
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", "{}"))
+	if w.Status != 400 || w.Body != "rpc: empty args" {
+		t.Errorf("Response was %d %q, should be 400 %q.", w.Status, w.Body, "rpc: empty args")
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", strings.Repeat(" ", maxBufferedBodyBytes+1)))
+	if w.Status != 413 {
+		t.Errorf("Status was %d, should be 413.", w.Status)
+	}
+}
+
+func TestSetRateLimiter(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetRateLimiter(NewRateLimiter(2, time.Minute))
+
+	for _, test := range []struct {
+		status    int
+		remaining string
+	}{
+		{200, "1"},
+		{200, "0"},
+		{429, "0"},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+		h := w.Header()
+		if w.Status != test.status || h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != test.remaining {
+			t.Errorf("Response was %d with limit %q and remaining %q, should be %d with limit %q and remaining %q.",
+				w.Status, h.Get("X-RateLimit-Limit"), h.Get("X-RateLimit-Remaining"), test.status, "2", test.remaining)
+		}
+		reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil || reset < time.Now().Unix() {
+			t.Errorf("X-RateLimit-Reset was %q, should be a future Unix time.", h.Get("X-RateLimit-Reset"))
+		}
+		if retry := h.Get("Retry-After"); (test.status == 429) != (retry == "60") {
+			t.Errorf("Retry-After was %q on a %d.", retry, w.Status)
+		}
+	}
+}
+
+// MockTracer records the spans it starts.
+type MockTracer struct {
+	Spans []*MockSpan
+}
+
+type mockSpanKey struct{}
+
+func (t *MockTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &MockSpan{Name: name}
+	if parent, ok := ctx.Value(mockSpanKey{}).(*MockSpan); ok {
+		span.Parent = parent.Name
+	}
+	t.Spans = append(t.Spans, span)
+	return context.WithValue(ctx, mockSpanKey{}, span), span
+}
+
+// Extract continues the trace of the span named in the X-Parent-Span header.
+func (t *MockTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if parent := header.Get("X-Parent-Span"); parent != "" {
+		return context.WithValue(ctx, mockSpanKey{}, &MockSpan{Name: parent})
+	}
+	return ctx
+}
+
+// MockSpan is a span started by a MockTracer.
+type MockSpan struct {
+	Name   string
+	Parent string
+	Errors []error
+	Status int
+	Ended  bool
+}
+
+func (s *MockSpan) SetStatus(code int) {
+	s.Status = code
+}
+
+func (s *MockSpan) RecordError(err error) {
+	s.Errors = append(s.Errors, err)
+}
+
+func (s *MockSpan) End() {
+	s.Ended = true
+}
+
+func TestSetTracer(t *testing.T) {
+	s := newMockJSONServer()
+
+	for _, test := range []struct {
+		method string
+		body   string
+		spans  string
+	}{
+		{"Service1.multiply", `{"A":2,"B":5}`, "Service1.multiply <nil>, decode <nil>, handler <nil>, encode <nil>"},
+		{"Service3.err", `{"A":3}`, "Service3.err service3 error, decode <nil>, handler service3 error, encode <nil>"},
+		{"Service1.multiply", `[]`, "Service1.multiply json: cannot unmarshal array into Go value of type rpc.Service1Request, " +
+			"decode json: cannot unmarshal array into Go value of type rpc.Service1Request"},
+	} {
+		tracer := new(MockTracer)
+		s.SetTracer(tracer)
+		s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest(test.method, test.body))
+		var spans []string
+		for i, span := range tracer.Spans {
+			if parent := test.method; i > 0 && span.Parent != parent {
+				t.Errorf("Parent of span %s was %q, should be %q.", span.Name, span.Parent, parent)
+			}
+			if !span.Ended {
+				t.Errorf("Span %s was not ended.", span.Name)
+			}
+			var err error
+			if len(span.Errors) > 0 {
+				err = span.Errors[0]
+			}
+			spans = append(spans, fmt.Sprintf("%s %v", span.Name, err))
+		}
+		if got := strings.Join(spans, ", "); got != test.spans {
+			t.Errorf("Spans were %q, should be %q.", got, test.spans)
+		}
+	}
+}
+
+func TestTracerHeadersAndStatus(t *testing.T) {
+	s := newMockJSONServer()
+	for _, test := range []struct {
+		method string
+		status int
+	}{
+		{"Service1.multiply", 200},
+		{"Service3.err", 504},
+		{"Service1.missing", 404},
+	} {
+		tracer := new(MockTracer)
+		s.SetTracer(tracer)
+		r := newMockJSONRequest(test.method, `{"A":2,"B":5}`)
+		r.Header.Set("X-Parent-Span", "client")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+		if len(tracer.Spans) == 0 {
+			t.Fatalf("%s: no span was started.", test.method)
+		}
+		span := tracer.Spans[0]
+		if span.Name != test.method || span.Parent != "client" {
+			t.Errorf("Request span was %s child of %q, should be %s child of %q.", span.Name, span.Parent, test.method, "client")
+		}
+		if span.Status != test.status {
+			t.Errorf("%s: status of the span was %d, should be %d.", test.method, span.Status, test.status)
+		}
+		for _, child := range tracer.Spans[1:] {
+			if child.Status != 0 {
+				t.Errorf("Status of span %s was %d, should only be set on the request span.", child.Name, child.Status)
+			}
+		}
+	}
+}
+
+func TestMethodFromContext(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterService(new(Service3), "Alias")
+
+	for _, method := range []string{"Service3.method", "Alias.method"} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(method, `{}`))
+		if w.Body != method {
+			t.Errorf("Method was %q, should be %q.", w.Body, method)
+		}
+	}
+}
+
+func TestSetMethodPrefixTrim(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetMethodPrefixTrim("RPC.")
+
+	for _, method := range []string{"RPC.Service1.multiply", "Service1.multiply"} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(method, `{"A":2,"B":5}`))
+		if expected := "{\"Result\":10}\n"; w.Status != 200 || w.Body != expected {
+			t.Errorf("%s: response was %d %q, should be 200 %q.", method, w.Status, w.Body, expected)
+		}
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("RPC.Service3.method", `{}`))
+	if w.Body != "Service3.method" {
+		t.Errorf("Method was %q, should be %q.", w.Body, "Service3.method")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	s := newMockJSONServer()
+	var calls []string
+	trace := func(name string) func(next HandlerFunc) HandlerFunc {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(r *http.Request, method string, args, reply interface{}) error {
+				calls = append(calls, name+" "+method)
+				err := next(r, method, args, reply)
+				calls = append(calls, name+" done")
+				return err
+			}
+		}
+	}
+	s.Wrap(trace("outer"))
+	s.Wrap(trace("inner"))
+	s.Wrap(func(next HandlerFunc) HandlerFunc {
+		return func(r *http.Request, method string, args, reply interface{}) error {
+			if args.(*Service1Request).A < 0 {
+				return errors.New("negative")
+			}
+			if err := next(r, method, args, reply); err != nil {
+				return err
+			}
+			reply.(*Service1Response).Result *= 10
+			return nil
+		}
+	})
+	blocked := false
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		if blocked {
+			return &InterruptInfo{Error: errors.New("denied"), StatusCode: 403}
+		}
+		return nil
+	})
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Status != 200 || w.Body != `{"Result":100}`+"\n" {
+		t.Errorf("Response was %d %q, should be the reply changed by the middleware.", w.Status, w.Body)
+	}
+	expected := "outer Service1.multiply, inner Service1.multiply, inner done, outer done"
+	if got := strings.Join(calls, ", "); got != expected {
+		t.Errorf("Calls were %q, should be %q.", got, expected)
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":-2,"B":5}`))
+	if w.Status != 400 || w.Body != "negative" {
+		t.Errorf("Response was %d %q, should be the error of the middleware.", w.Status, w.Body)
+	}
+
+	// Interrupt funcs run before the middlewares.
+	calls, blocked = nil, true
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Status != 403 || len(calls) != 0 {
+		t.Errorf("Status was %d with calls %q, should be 403 without calls.", w.Status, calls)
+	}
+
+	// In-process calls are wrapped too.
+	var res Service1Response
+	if err := s.Call(context.Background(), "Service1.multiply", &Service1Request{3, 4}, &res); err != nil || res.Result != 120 {
+		t.Errorf("Call returned %d and %v, should return 120.", res.Result, err)
+	}
+
+	s.Wrap(func(next HandlerFunc) HandlerFunc {
+		return func(r *http.Request, method string, args, reply interface{}) error {
+			return next(r, method, args, new(Service1Request))
+		}
+	})
+	if err := s.Call(context.Background(), "Service1.multiply", &Service1Request{3, 4}, &res); err == nil {
+		t.Error("Calling next with a reply of another type should fail.")
+	}
+}
+
+func TestCall(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterService(&Service4{}, "")
+
+	var res Service1Response
+	if err := s.Call(context.Background(), "Service1.multiply", &Service1Request{2, 5}, &res); err != nil || res.Result != 10 {
+		t.Errorf("Call returned %v %v, should return 10 <nil>.", res.Result, err)
+	}
+	if err := s.Call(context.Background(), "Service3.method", &Service1Request{}, &res); err == nil || err.Error() != "Service3.method" {
+		t.Errorf("Error was %v, should be Service3.method.", err)
+	}
+	for _, test := range []struct {
+		method     string
+		args, resp interface{}
+	}{
+		{"Service1.divide", &Service1Request{}, &res},
+		{"Service1.multiply", Service1Request{}, &res},
+		{"Service1.multiply", (*Service1Request)(nil), &res},
+		{"Service1.multiply", &Service1Request{}, nil},
+		{"Service1.multiply", &Service1Request{}, &Service1Request{}},
+		{"Service4.count", &Service1Request{}, &res},
+	} {
+		if err := s.Call(context.Background(), test.method, test.args, test.resp); err == nil {
+			t.Errorf("Expected an error calling %s with %T and %T.", test.method, test.args, test.resp)
+		}
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	s := newMockJSONServer()
+
+	result := s.Benchmark("Service1.multiply", &Service1Request{2, 5}, 4, 100)
+	if result.Iterations != 100 || result.Errors != 0 {
+		t.Errorf("Benchmark made %d calls with %d errors, should make 100 calls without errors.", result.Iterations, result.Errors)
+	}
+	if result.Throughput <= 0 || result.Duration <= 0 {
+		t.Errorf("Throughput was %v over %v, should be positive.", result.Throughput, result.Duration)
+	}
+	if result.P50 > result.P90 || result.P90 > result.P99 || result.P99 > result.Max {
+		t.Errorf("Latencies were %v %v %v %v, should be increasing.", result.P50, result.P90, result.P99, result.Max)
+	}
+
+	if result := s.Benchmark("Service1.divide", &Service1Request{}, 2, 10); result.Errors != 10 {
+		t.Errorf("Benchmark had %d errors, should have 10.", result.Errors)
+	}
+}
+
+func TestDeprecateMethod(t *testing.T) {
+	s := newMockJSONServer()
+	sunset := time.Date(2030, time.January, 2, 15, 4, 5, 0, time.FixedZone("CET", 3600))
+	s.DeprecateMethod("Service1.multiply", "use Service1.mul", sunset)
+	s.DeprecateMethod("Service3.ping", "", time.Time{})
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	for name, want := range map[string]string{
+		"Deprecation": "true",
+		"Warning":     `299 - "use Service1.mul"`,
+		"Sunset":      "Wed, 02 Jan 2030 14:04:05 GMT",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s was %q, should be %q.", name, got, want)
+		}
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.ping", ""))
+	if h := w.Header(); h.Get("Deprecation") != "true" || h.Get("Warning") != "" || h.Get("Sunset") != "" {
+		t.Errorf("Headers were %v, should only have Deprecation.", h)
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.method", `{}`))
+	if h := w.Header().Get("Deprecation"); h != "" {
+		t.Errorf("Deprecation was %q, should be unset.", h)
+	}
+}
+
+func TestSetReadOnlyMethods(t *testing.T) {
+	s := newMockJSONServer()
+
+	head := func(method string) *http.Request {
+		r := newMockJSONRequest(method, `{"A":2,"B":5}`)
+		r.Method = "HEAD"
+		return r
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, head("Service1.multiply"))
+	if w.Status != 405 {
+		t.Errorf("Status was %d, should be 405.", w.Status)
+	}
+
+	s.SetReadOnlyMethods("Service1.multiply")
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, head("Service1.multiply"))
+	h := w.Header()
+	if w.Status != 200 || w.Body != "" || h.Get("Content-Type") != "application/json" || h.Get("Content-Length") != "14" {
+		t.Errorf("Response was %d %q with headers %v, should be 200 with an empty body and the headers of the POST response.", w.Status, w.Body, h)
+	}
+
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, head("Service3.method"))
+	if w.Status != 405 || w.Body != "" {
+		t.Errorf("Response was %d %q, should be 405 with an empty body.", w.Status, w.Body)
+	}
+}
+
+func TestInterruptErrorStatus(t *testing.T) {
+	s := newMockJSONServer()
+	var interrupt *InterruptInfo
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		return interrupt
+	})
+
+	for _, test := range []struct {
+		interrupt *InterruptInfo
+		status    int
+	}{
+		{nil, 200},
+		{&InterruptInfo{}, 200},
+		{&InterruptInfo{Error: errors.New("denied"), StatusCode: 403}, 403},
+		{&InterruptInfo{Error: errors.New("denied")}, 400},
+		{&InterruptInfo{Error: context.DeadlineExceeded, StatusCode: 403}, 504},
+	} {
+		interrupt = test.interrupt
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+		if w.Status != test.status {
+			t.Errorf("%+v: status was %d, should be %d.", test.interrupt, w.Status, test.status)
+		}
+	}
+}
+
+func TestInterruptHeaders(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		return &InterruptInfo{
+			Error:      errors.New("rate limit exceeded"),
+			StatusCode: 429,
+			Headers:    http.Header{"Retry-After": {"30"}, "X-Ratelimit-Remaining": {"0"}},
+		}
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Code != 429 {
+		t.Errorf("Status was %d, should be 429.", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After was %q, should be 30.", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining was %q, should be 0.", got)
+	}
+}
+
+func TestInterruptResponse(t *testing.T) {
+	s := newMockJSONServer()
+	cached := &Service1Response{Result: 42}
+	var interrupt *InterruptInfo
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		return interrupt
+	})
+	// The method would reply {"Result":10}.
+	for _, test := range []struct {
+		interrupt *InterruptInfo
+		status    int
+		body      string
+	}{
+		{&InterruptInfo{Response: cached}, 200, `{"Result":42}`},
+		{&InterruptInfo{Response: cached, StatusCode: 203}, 203, `{"Result":42}`},
+		{&InterruptInfo{Response: cached, Error: errors.New("denied"), StatusCode: 403}, 403, "denied"},
+	} {
+		interrupt = test.interrupt
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+		if w.Status != test.status || strings.TrimSpace(w.Body) != test.body {
+			t.Errorf("%+v: response was %d %q, should be %d %q.", test.interrupt, w.Status, w.Body, test.status, test.body)
+		}
+	}
+}
+
+func TestTupleReply(t *testing.T) {
+	s := newMockJSONServer()
+
+	for _, test := range []struct {
+		body   string
+		status int
+		resp   string
+	}{
+		{`{"A":2,"B":5}`, 200, "[10,\"7\"]\n"},
+		{`{"A":-1,"B":5}`, 400, "negative"},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service3.pair", test.body))
+		if w.Status != test.status || w.Body != test.resp {
+			t.Errorf("Response was %d %q, should be %d %q.", w.Status, w.Body, test.status, test.resp)
+		}
+	}
+
+	var reply []interface{}
+	if err := s.Call(context.Background(), "Service3.pair", &Service1Request{2, 5}, &reply); err != nil || fmt.Sprint(reply) != "[10 7]" {
+		t.Errorf("Call returned %v %v, should return [10 7] <nil>.", reply, err)
+	}
+	err := s.ReplaceMethod("Service3.pair", func(r *http.Request, req *Service1Request) (int, string, error) {
+		return 0, "replaced", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.pair", `{}`))
+	if w.Body != "[0,\"replaced\"]\n" {
+		t.Errorf("Response was %q, should be %q.", w.Body, "[0,\"replaced\"]\n")
+	}
+}
+
+func TestSetServiceShards(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetServiceShards(8)
+	s.RegisterService(new(Service1), "Foo")
+
+	for _, method := range []string{"Service1.multiply", "Service3.ping", "Foo.multiply"} {
+		if !s.HasMethod(method) {
+			t.Errorf("Expected to be registered: %s", method)
+		}
+	}
+	if err := s.RegisterService(new(Service1), "Foo"); err == nil {
+		t.Error("Expected an error registering Foo twice.")
+	}
+	s.SetServiceShards(1)
+	if !s.HasMethod("Foo.multiply") || s.HasMethod("Foo.divide") {
+		t.Error("Expected the services to be kept when unsharding.")
+	}
+}
+
+func benchmarkServiceMap(b *testing.B, shards int) {
+	s := NewServer()
+	s.SetServiceShards(shards)
+	methods := make([]string, 1000)
+	for i := range methods {
+		name := "Service" + strconv.Itoa(i)
+		s.RegisterService(new(Service1), name)
+		methods[i] = name + ".multiply"
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			s.services.get(methods[i%len(methods)])
+		}
+	})
+}
+
+func BenchmarkServiceMap(b *testing.B) {
+	benchmarkServiceMap(b, 1)
+}
+
+func BenchmarkServiceMapSharded(b *testing.B) {
+	benchmarkServiceMap(b, 16)
+}
+
+func TestSetLastModified(t *testing.T) {
+	s := newMockJSONServer()
+
+	for _, test := range []struct {
+		since  string
+		status int
+		body   string
+	}{
+		{"", 200, "{\"Result\":1000000000}\n"},
+		{time.Unix(999999999, 0).UTC().Format(http.TimeFormat), 200, "{\"Result\":1000000000}\n"},
+		{time.Unix(1000000000, 0).UTC().Format(http.TimeFormat), 304, ""},
+		{time.Unix(1000000001, 0).UTC().Format(http.TimeFormat), 304, ""},
+		{"yesterday", 200, "{\"Result\":1000000000}\n"},
+	} {
+		r := newMockJSONRequest("Service3.modified", `{"A":1000000000}`)
+		if test.since != "" {
+			r.Header.Set("If-Modified-Since", test.since)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != test.status || w.Body != test.body {
+			t.Errorf("%q: response was %d %q, should be %d %q.", test.since, w.Status, w.Body, test.status, test.body)
+		}
+		if got, want := w.Header().Get("Last-Modified"), "Sun, 09 Sep 2001 01:46:40 GMT"; got != want {
+			t.Errorf("Last-Modified was %q, should be %q.", got, want)
+		}
+	}
+
+	// Methods not setting it get no header.
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if got := w.Header().Get("Last-Modified"); got != "" {
+		t.Errorf("Last-Modified was %q, should be unset.", got)
+	}
+}
+
+// sum is a generic handler.
+func sum[T int | float64](ctx context.Context, req *[2]T) (*T, error) {
+	res := req[0] + req[1]
+	return &res, nil
+}
+
+func TestAdapt(t *testing.T) {
+	s := newMockJSONServer()
+	if err := s.RegisterFunc(Adapt("Math.sum", sum[int])); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFunc(Adapt("Service1.sum", sum[float64])); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method string
+		body   string
+		resp   string
+	}{
+		{"Math.sum", `[2,5]`, "7\n"},
+		{"Service1.sum", `[2.5,5]`, "7.5\n"},
+		{"Service1.multiply", `{"A":2,"B":5}`, "{\"Result\":10}\n"},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, test.body))
+		if w.Status != 200 || w.Body != test.resp {
+			t.Errorf("%s: response was %d %q, should be 200 %q.", test.method, w.Status, w.Body, test.resp)
+		}
+	}
+
+	var res int
+	if err := s.Call(context.Background(), "Math.sum", &[2]int{1, 2}, &res); err != nil || res != 3 {
+		t.Errorf("Call returned %v %v, should return 3 <nil>.", res, err)
+	}
+	for method, fn := range map[string]interface{}{
+		"Math.sum":    func(r *http.Request, req *[2]int, res *int) error { return nil },
+		"Math":        func(r *http.Request, req *[2]int, res *int) error { return nil },
+		"Math.nil":    nil,
+		"Math.divide": func(req *[2]int) error { return nil },
+	} {
+		if err := s.RegisterFunc(method, fn); err == nil {
+			t.Errorf("Expected an error registering %s.", method)
+		}
+	}
+}
+
+func TestSetErrorLogger(t *testing.T) {
+	s := newMockJSONServer()
+	var logged []string
+	s.SetErrorLogger(func(r *http.Request, method string, status int, err error) {
+		logged = append(logged, fmt.Sprintf("%s %d %v", method, status, err))
+	})
+
+	for _, test := range []struct {
+		method, body, contentType string
+		logged                    string
+	}{
+		{"Service1.multiply", `{"A":2,"B":5}`, "application/json", ""},
+		{"Service1.multiply", `{"A":2,"B":5}`, "text/plain", " 415 rpc: unrecognized Content-Type: text/plain"},
+		{"Service1.multiply", `[]`, "application/json",
+			"Service1.multiply 400 json: cannot unmarshal array into Go value of type rpc.Service1Request"},
+		{"Service3.err", `{"A":3}`, "application/json", "Service3.err 400 service3 error"},
+	} {
+		logged = nil
+		r := newMockJSONRequest(test.method, test.body)
+		r.Header.Set("Content-Type", test.contentType)
+		s.ServeHTTP(NewMockResponseWriter(), r)
+		if got := strings.Join(logged, "; "); got != test.logged {
+			t.Errorf("Logged %q, should log %q.", got, test.logged)
+		}
+	}
+}
+
+func TestSetFlushInterval(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterFunc("Big.reply", func(r *http.Request, req *Service1Request, res *string) error {
+		*res = strings.Repeat("x", req.A)
+		return nil
+	})
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Big.reply", `{"A":2500}`))
+	if w.Flushes != 0 {
+		t.Errorf("Flushed %d times, should not flush.", w.Flushes)
+	}
+
+	s.SetFlushInterval(1000)
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Big.reply", `{"A":2500}`))
+	// 2503 bytes with the quotes and the newline.
+	if w.Flushes != 2 || len(w.Body) != 2503 {
+		t.Errorf("Flushed %d times for %d bytes, should flush 2 times for 2503 bytes.", w.Flushes, len(w.Body))
+	}
+}
+
+type roleKey struct{}
+
+func TestSetFieldFilter(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterService(&Service4{}, "")
+	s.SetFieldFilter(func(ctx context.Context, reply interface{}) interface{} {
+		if ctx.Value(roleKey{}) == "admin" {
+			return reply
+		}
+		switch reply := reply.(type) {
+		case *Service1Response:
+			return map[string]interface{}{}
+		case Service1Response:
+			return reply.Result % 2
+		}
+		return reply
+	})
+
+	for _, test := range []struct {
+		role, method, body, resp string
+	}{
+		{"admin", "Service1.multiply", `{"A":2,"B":5}`, "{\"Result\":10}\n"},
+		{"anonymous", "Service1.multiply", `{"A":2,"B":5}`, "{}\n"},
+		{"admin", "Service4.count", `{"A":1,"B":3}`, `{"result":[{"Result":1},{"Result":2}],"error":null}`},
+		{"anonymous", "Service4.count", `{"A":1,"B":3}`, `{"result":[1,0],"error":null}`},
+	} {
+		r := newMockJSONRequest(test.method, test.body)
+		r = r.WithContext(context.WithValue(r.Context(), roleKey{}, test.role))
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != test.resp {
+			t.Errorf("%s %s: response was %q, should be %q.", test.role, test.method, w.Body, test.resp)
+		}
+	}
+}
+
+func TestWriteResponseError(t *testing.T) {
+	s := newMockJSONServer()
+	var info InstrumentInfo
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		info = *i
+	})
+
+	w := NewMockResponseWriter()
+	w.WriteErr = errors.New("connection reset")
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if info.StatusCode != 0 || info.Error != w.WriteErr {
+		t.Errorf("Instrument func saw %d %v, should see 0 %v.", info.StatusCode, info.Error, w.WriteErr)
+	}
+
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if info.StatusCode != 200 || info.Error != nil {
+		t.Errorf("Instrument func saw %d %v, should see 200 <nil>.", info.StatusCode, info.Error)
+	}
+}
+
+func TestRegisterMethodExamples(t *testing.T) {
+	s := newMockJSONServer()
+
+	for _, test := range []struct {
+		method    string
+		req, resp interface{}
+		valid     bool
+	}{
+		{"Service1.multiply", Service1Request{2, 5}, &Service1Response{10}, true},
+		{"Service1.multiply", json.RawMessage(`{"A":2,"B":5}`), json.RawMessage(`{"Result":10}`), true},
+		{"Service1.multiply", Service1Response{10}, Service1Response{10}, false},
+		{"Service1.multiply", json.RawMessage(`{"A":2,"C":5}`), Service1Response{10}, false},
+		{"Service1.multiply", Service1Request{2, 5}, json.RawMessage(`{"Result":"10"}`), false},
+		{"Service1.divide", Service1Request{2, 5}, Service1Response{10}, false},
+	} {
+		err := s.RegisterMethodExamples(test.method, test.req, test.resp)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %T %T: error was %v, should be valid: %v.", test.method, test.req, test.resp, err, test.valid)
+		}
+	}
+	if _, resp, ok := s.MethodExamples("Service1.multiply"); !ok || string(resp.(json.RawMessage)) != `{"Result":10}` {
+		t.Errorf("Response example was %v, should be the last valid one.", resp)
+	}
+}
+
+func TestSetPprofLabels(t *testing.T) {
+	s := newMockJSONServer()
+
+	for _, enabled := range []bool{false, true} {
+		s.SetPprofLabels(enabled)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service3.label", `{}`))
+		if want := map[bool]string{true: "Service3.label"}[enabled]; w.Body != want {
+			t.Errorf("Label was %q, should be %q.", w.Body, want)
+		}
+	}
+}
+
+func TestSetWorkerPool(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetWorkerPool(1)
+	started, release := make(chan bool), make(chan bool)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		started <- true
+		<-release
+		res.Result = req.A * req.B
+		return nil
+	})
+
+	// The first call runs on the worker, the second one waits in the queue.
+	statuses := make(chan int, 2)
+	serve := func() {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+		statuses <- w.Status
+	}
+	go serve()
+	<-started
+	go serve()
+	for len(s.loadWorkerPool().jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Status != 503 {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+
+	close(release)
+	<-started
+	for i := 0; i < 2; i++ {
+		if status := <-statuses; status != 200 {
+			t.Errorf("Status was %d, should be 200.", status)
+		}
+	}
+
+	// The pool can be replaced while serving.
+	s = newMockJSONServer()
+	s.SetWorkerPool(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := NewMockResponseWriter()
+				s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+				if w.Status != 200 && w.Status != 503 {
+					t.Errorf("Status was %d, should be 200 or 503.", w.Status)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		s.SetWorkerPool(i%3 + 1)
+	}
+	wg.Wait()
+	s.SetWorkerPool(0)
+}
+
+func TestSetMethodSuccessStatus(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetMethodSuccessStatus(map[string]int{
+		"Service1.multiply": 201,
+		"Service3.ping":     204,
+		"Service3.err":      201,
+	})
+
+	for _, test := range []struct {
+		method string
+		status int
+		body   bool
+	}{
+		{"Service1.multiply", 201, true},
+		{"Service3.ping", 204, false},
+		{"Service3.err", 504, true},
+		{"Service3.pair", 200, true},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, `{"A":2,"B":5}`))
+		if w.Status != test.status || (w.Body != "") != test.body {
+			t.Errorf("%s: response was %d %q, should be %d with a body: %v.", test.method, w.Status, w.Body, test.status, test.body)
+		}
+	}
+}
+
+func TestRegisterServiceWithAllocators(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+	args, reply := new(Service1Request), new(Service1Response)
+	err := s.RegisterServiceWithAllocators(new(Service1), "", map[string]func() (interface{}, interface{}){
+		"Multiply": func() (interface{}, interface{}) { return args, reply },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if args.A != 2 || reply.Result != 10 || w.Body != `{"Result":10}`+"\n" {
+		t.Errorf("Args were %v and reply %v, wrote %q; should be the allocated values.", args, reply, w.Body)
+	}
+
+	for _, alloc := range []map[string]func() (interface{}, interface{}){
+		{"Divide": func() (interface{}, interface{}) { return nil, nil }},
+		{"Multiply": func() (interface{}, interface{}) { return new(Service1Response), nil }},
+	} {
+		if err := NewServer().RegisterServiceWithAllocators(new(Service1), "", alloc); err == nil {
+			t.Errorf("Registering %v should fail.", alloc)
+		}
+	}
+}
+
+func TestSetArgsFactory(t *testing.T) {
+	s := newMockJSONServer()
+	s.EnablePooling(true)
+	if err := s.SetArgsFactory("Service1.multiply", func() interface{} { return &Service1Request{B: 10} }); err != nil {
+		t.Fatal(err)
+	}
+	for body, expected := range map[string]string{
+		`{"A":2}`:       `{"Result":20}`,
+		`{"A":2,"B":3}`: `{"Result":6}`,
+	} {
+		// Twice, so a pooled value would have lost the default.
+		for i := 0; i < 2; i++ {
+			w := NewMockResponseWriter()
+			s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", body))
+			if w.Body != expected+"\n" {
+				t.Errorf("Response to %s was %q, should be %q.", body, w.Body, expected)
+			}
+		}
+	}
+
+	// The reply keeps the defaults the method doesn't overwrite.
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		return nil
+	})
+	if err := s.SetReplyFactory("Service1.multiply", func() interface{} { return &Service1Response{Result: -1} }); err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2}`))
+	if w.Body != `{"Result":-1}`+"\n" {
+		t.Errorf("Response was %q, should be the default reply.", w.Body)
+	}
+
+	// A nil factory restores the zero values.
+	s.SetArgsFactory("Service1.multiply", nil)
+	s.SetReplyFactory("Service1.multiply", nil)
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2}`))
+	if w.Body != `{"Result":0}`+"\n" {
+		t.Errorf("Response was %q, should be the zero reply.", w.Body)
+	}
+
+	for _, test := range []struct {
+		method  string
+		factory func() interface{}
+		reply   bool
+	}{
+		{"Service1.missing", func() interface{} { return new(Service1Request) }, false},
+		{"Service1.multiply", func() interface{} { return new(Service1Response) }, false},
+		{"Service1.multiply", func() interface{} { return Service1Response{} }, true},
+		{"Service1.multiply", func() interface{} { return nil }, false},
+	} {
+		set := s.SetArgsFactory
+		if test.reply {
+			set = s.SetReplyFactory
+		}
+		if err := set(test.method, test.factory); err == nil {
+			t.Errorf("Setting a factory of %T for %s should fail.", test.factory(), test.method)
+		}
+	}
+}
+
+func BenchmarkAllocators(b *testing.B) {
+	args, reply := new(Service1Request), new(Service1Response)
+	allocators := map[string]func() (interface{}, interface{}){
+		"Multiply": func() (interface{}, interface{}) { return args, reply },
+	}
+	for name, allocators := range map[string]map[string]func() (interface{}, interface{}){
+		"reflect":   nil,
+		"allocator": allocators,
+	} {
+		b.Run(name, func(b *testing.B) {
+			s := NewServer()
+			s.RegisterCodec(MockCodec{2, 5}, "mock")
+			s.RegisterServiceWithAllocators(new(Service1), "", allocators)
+			r, _ := http.NewRequest("POST", "", nil)
+			r.Header.Set("Content-Type", "mock")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.ServeHTTP(NewMockResponseWriter(), r)
+			}
+		})
+	}
+}
+
+func TestSetReadTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	s := newMockJSONServer()
+	s.SetReadTimeout(timeout)
+	// The handler fails if the request context is cancelled by the read
+	// deadline expiring while it runs.
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		time.Sleep(2 * timeout)
+		res.Result = req.A * req.B
+		return r.Context().Err()
+	})
+	var replaced atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		s.ServeHTTP(w, r)
+		if r.Body != body {
+			replaced.Store(true)
+		}
+	}))
+	defer ts.Close()
+
+	// send writes a request announcing length bytes of body, with only the
+	// given body, and returns the response.
+	send := func(body string, length int) *http.Response {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST /?method=Service1.multiply HTTP/1.1\r\nHost: test\r\n"+
+			"Content-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", length, body)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+	body := `{"A":2,"B":5}`
+	if res := send(body[:7], len(body)); res.StatusCode != 408 {
+		t.Errorf("Status of a stalled body was %d, should be 408.", res.StatusCode)
+	}
+	if res := send(body, len(body)); res.StatusCode != 200 {
+		t.Errorf("Status of a slow method was %d, should be 200.", res.StatusCode)
+	}
+	if replaced.Load() {
+		t.Error("The body of the request of the caller should not be replaced.")
+	}
+}
+
+func TestSetRequestTimeout(t *testing.T) {
+	const step = 60 * time.Millisecond
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.SetRequestTimeout(100 * time.Millisecond)
+	var decodeDelay time.Duration
+	s.RegisterCodec(MockJSONCodec{Decode: func(body io.Reader, args interface{}) error {
+		time.Sleep(decodeDelay)
+		return json.NewDecoder(body).Decode(args)
+	}}, "application/json")
+	// The handler sleeps for B milliseconds, it may still run after the
+	// response.
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		time.Sleep(time.Duration(req.B) * time.Millisecond)
+		res.Result = req.A * req.B
+		return nil
+	})
+
+	for _, test := range []struct {
+		decode, handler time.Duration
+		status          int
+	}{
+		{step, 0, 200},
+		{0, step, 200},
+		{step, step, 504},
+		{2 * step, 0, 504},
+	} {
+		decodeDelay = test.decode
+		w := NewMockResponseWriter()
+		body := fmt.Sprintf(`{"A":2,"B":%d}`, test.handler/time.Millisecond)
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", body))
+		if w.Status != test.status {
+			t.Errorf("Status with a %v decode and a %v handler was %d, should be %d.", test.decode, test.handler, w.Status, test.status)
+		}
+	}
+}
+
+func TestContextMethod(t *testing.T) {
+	s := newMockJSONServer()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, method := range []string{"Service3.deadline", "Service1.multiply"} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(method, `{"A":2,"B":5}`).WithContext(ctx))
+		if w.Status != 200 || w.Body != `{"Result":10}`+"\n" {
+			t.Errorf("%s: response was %d %q, should be 200 with the product.", method, w.Status, w.Body)
+		}
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service3.deadline", `{"A":2,"B":5}`))
+	if w.Status != 400 || w.Body != "no deadline" {
+		t.Errorf("Response was %d %q, should be 400 without a deadline.", w.Status, w.Body)
+	}
+}
+
+func TestReturnedReply(t *testing.T) {
+	s := newMockJSONServer()
+
+	for _, test := range []struct {
+		method, body, reply string
+	}{
+		{"Service3.product", `{"A":2,"B":5}`, `{"Result":10}`},
+		{"Service3.product", `{"A":0,"B":5}`, `{"Result":0}`},
+		{"Service1.multiply", `{"A":2,"B":5}`, `{"Result":10}`},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, test.body))
+		if w.Status != 200 || w.Body != test.reply+"\n" {
+			t.Errorf("%s %s: response was %d %q, should be 200 with %s.", test.method, test.body, w.Status, w.Body, test.reply)
+		}
+	}
+}
+
+func TestAddInterruptFunc(t *testing.T) {
+	s := newMockJSONServer()
+	var calls []string
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		calls = append(calls, "replaced")
+		return nil
+	})
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		calls = append(calls, "auth")
+		i.Request.Header.Set("X-User", "alice")
+		return nil
+	})
+	s.AddInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		calls = append(calls, "check")
+		if i.Request.Header.Get("X-User") != "alice" || i.Method == "Service1.divide" {
+			return &InterruptInfo{Error: errors.New("denied"), StatusCode: 403}
+		}
+		return nil
+	})
+	s.AddInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		calls = append(calls, "log")
+		return nil
+	})
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if want := []string{"auth", "check", "log"}; w.Status != 200 || !reflect.DeepEqual(calls, want) {
+		t.Errorf("Status was %d after %v, should be 200 after %v.", w.Status, calls, want)
+	}
+
+	calls = nil
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.divide", `{"A":2,"B":5}`))
+	if want := []string{"auth", "check"}; w.Status != 403 || !reflect.DeepEqual(calls, want) {
+		t.Errorf("Status was %d after %v, should be 403 after %v.", w.Status, calls, want)
+	}
+}
+
+func TestAddInstrumentFunc(t *testing.T) {
+	s := newMockJSONServer()
+	var infos []*InstrumentInfo
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		infos = append(infos, i)
+	})
+	s.AddInstrumentFunc(func(i *InstrumentInfo) {
+		infos = append(infos, i)
+	})
+
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service3.err", `{"A":3}`))
+	if len(infos) != 2 || infos[0] != infos[1] {
+		t.Fatalf("Got %v, should be the same info twice.", infos)
+	}
+	if infos[0].Method != "Service3.err" || infos[0].StatusCode != 400 {
+		t.Errorf("Got %s with status %d, should be Service3.err with status 400.", infos[0].Method, infos[0].StatusCode)
+	}
+}
+
+func TestRequestTimeoutSlowHandler(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetRequestTimeout(20 * time.Millisecond)
+	release := make(chan bool)
+	defer close(release)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		// Ignore the context.
+		<-release
+		res.Result = req.A * req.B
+		return nil
+	})
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Status != 504 || w.Body != context.DeadlineExceeded.Error() {
+		t.Errorf("Response was %d %q, should be 504 with %q.", w.Status, w.Body, context.DeadlineExceeded)
+	}
+}
+
+func TestResponseCodec(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterCodec(MockTextCodec{MockCodec{2, 5}}, "text/plain")
+
+	for _, test := range []struct {
+		method, accept, body string
+	}{
+		{"Service1.multiply", "", `{"Result":10}` + "\n"},
+		{"Service1.multiply", "text/plain", "&{Result:10}"},
+		{"Service1.multiply", "application/msgpack, text/plain;q=0.5", "&{Result:10}"},
+		{"Service1.multiply", "text/plain;q=0.5, application/json", `{"Result":10}` + "\n"},
+		{"Service1.multiply", "*/*, text/plain", `{"Result":10}` + "\n"},
+		{"Service1.multiply", "application/msgpack", `{"Result":10}` + "\n"},
+		{"Service3.err", "text/plain", "error: context deadline exceeded"},
+	} {
+		r := newMockJSONRequest(test.method, `{"A":2,"B":5}`)
+		r.Header.Set("Accept", test.accept)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != test.body {
+			t.Errorf("%s with Accept %q: response was %q, should be %q.", test.method, test.accept, w.Body, test.body)
+		}
+	}
+}
+
+func TestUnregisterService(t *testing.T) {
+	s := NewServer()
+	rcvr := new(Service1)
+	if err := s.RegisterService(rcvr, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(rcvr, "Math"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.UnregisterService("Service1"); err != nil {
+			t.Fatal(err)
+		}
+		if s.HasMethod("Service1.multiply") || !s.HasMethod("Math.multiply") {
+			t.Error("Only Service1 should be unregistered.")
+		}
+		if err := s.UnregisterService("Service1"); !errors.Is(err, ErrServiceNotFound) {
+			t.Errorf("Unregistering again returned %v, should match ErrServiceNotFound.", err)
+		}
+		if err := s.RegisterService(rcvr, ""); err != nil {
+			t.Fatal(err)
+		}
+		if !s.HasMethod("Service1.multiply") {
+			t.Error("Service1 should be registered again.")
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+
+	want := MethodInfo{
+		Name:      "Service1.multiply",
+		ArgsType:  reflect.TypeOf(Service1Request{}),
+		ReplyType: reflect.TypeOf(Service1Response{}),
+	}
+	add := want
+	add.Name = "Service1.add"
+	if methods := s.Methods(); !reflect.DeepEqual(methods, []MethodInfo{add, want}) {
+		t.Errorf("Methods were %v, should be %v.", methods, []MethodInfo{add, want})
+	}
+	if info, ok := s.MethodInfo("Service1.multiply"); !ok || info != want {
+		t.Errorf("MethodInfo was %v, should be %v.", info, want)
+	}
+	if _, ok := s.MethodInfo("Service1.divide"); ok {
+		t.Error("Service1.divide should not be found.")
+	}
+
+	s.RegisterService(new(Service4), "")
+	methods := s.Methods()
+	if !sort.SliceIsSorted(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name }) {
+		t.Errorf("Methods were not sorted: %v.", methods)
+	}
+}
+
+func TestSetMethodNameFunc(t *testing.T) {
+	s := NewServer()
+	s.SetMethodNameFunc(func(service, method string) string { return method })
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+
+	if !s.HasMethod("Service1.Multiply") || s.HasMethod("Service1.multiply") {
+		t.Error("Only Service1.Multiply should be found.")
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.Multiply", `{"A":2,"B":5}`))
+	if w.Status != 200 || w.Body != `{"Result":10}`+"\n" {
+		t.Errorf("Response was %d %q, should be 200 with the product.", w.Status, w.Body)
+	}
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if w.Status != 404 {
+		t.Errorf("Status was %d, should be 404.", w.Status)
+	}
+
+	// Case-insensitive names.
+	s = NewServer()
+	s.SetMethodNameFunc(func(service, method string) string { return strings.ToLower(method) })
+	s.RegisterService(new(Service1), "")
+	if !s.HasMethod("Service1.Multiply") || !s.HasMethod("Service1.MULTIPLY") {
+		t.Error("Service1.multiply should be found in any case.")
+	}
+
+	// The settings of the methods apply to the names in any case.
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+	s.SetMethodSuccessStatus(map[string]int{"Service1.MULTIPLY": 201})
+	s.DeprecateMethod("Service1.Multiply", "", time.Time{})
+	s.SetMethodCache("Service1.multiply", time.Minute)
+	var instrumented []*InstrumentInfo
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		instrumented = append(instrumented, i)
+	})
+	for _, method := range []string{"Service1.Multiply", "Service1.mUlTiPlY"} {
+		w = NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(method, `{"A":2,"B":5}`))
+		if w.Status != 201 || w.Header().Get("Deprecation") != "true" {
+			t.Errorf("Expected %s to get a 201 and a Deprecation header, but got %d and %v", method, w.Status, w.Header())
+		}
+	}
+	if len(instrumented) != 2 || instrumented[0].Method != "Service1.multiply" || !instrumented[1].CacheHit {
+		t.Errorf("Expected the calls to be instrumented as Service1.multiply, the second from the cache, but got %+v", instrumented)
+	}
+}
+
+// Service5 has methods colliding by case.
+type Service5 struct {
+}
+
+func (t *Service5) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *Service5) MULTIPLY(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func TestSetAllowOverwrite(t *testing.T) {
+	lower := func(service, method string) string { return strings.ToLower(method) }
+	s := NewServer()
+	s.SetMethodNameFunc(lower)
+	err := s.RegisterService(new(Service5), "")
+	if err == nil || !strings.Contains(err.Error(), "MULTIPLY") || !strings.Contains(err.Error(), "Multiply") {
+		t.Errorf("Registering colliding methods returned %v, should fail naming both.", err)
+	}
+	if s.HasMethod("Service5.multiply") {
+		t.Error("Service5 should not be registered.")
+	}
+
+	s = NewServer()
+	s.SetMethodNameFunc(lower)
+	s.SetAllowOverwrite(true)
+	if err := s.RegisterService(new(Service5), ""); err != nil || !s.HasMethod("Service5.multiply") {
+		t.Errorf("Registering colliding methods returned %v, should register Service5.multiply.", err)
+	}
+}
+
+func TestSetCaseInsensitive(t *testing.T) {
+	s := NewServer()
+	s.SetCaseInsensitive(true)
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+	var interrupted, instrumented string
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		interrupted = i.Method
+		return nil
+	})
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		instrumented = i.Method
+	})
+
+	for _, method := range []string{"Service1.multiply", "Service1.Multiply", "service1.MULTIPLY"} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(method, `{"A":2,"B":5}`))
+		if w.Status != 200 || w.Body != `{"Result":10}`+"\n" {
+			t.Errorf("%s: response was %d %q, should be 200 with the product.", method, w.Status, w.Body)
+		}
+		if interrupted != "Service1.multiply" || instrumented != "Service1.multiply" {
+			t.Errorf("%s: reported as %q and %q, should be Service1.multiply.", method, interrupted, instrumented)
+		}
+		if !s.HasMethod(method) {
+			t.Errorf("%s should be found.", method)
+		}
+	}
+
+	if err := s.RegisterService(new(Service5), ""); err == nil {
+		t.Error("Registering methods colliding by case should fail.")
+	}
+	if err := s.RegisterService(new(Service1), "SERVICE1"); err == nil {
+		t.Error("Registering a service colliding by case should fail.")
+	}
+	s.UnregisterService("Service1")
+	if err := s.RegisterService(new(Service1), "SERVICE1"); err != nil || !s.HasMethod("service1.multiply") {
+		t.Errorf("Registering SERVICE1 again returned %v, should succeed.", err)
+	}
+}
+
+func TestSetMaxBodyBytes(t *testing.T) {
+	s := newMockJSONServer()
+	body := `{"A":2,"B":5}`
+
+	for _, test := range []struct {
+		max    int64
+		status int
+	}{
+		{0, 200},
+		{int64(len(body)), 200},
+		{int64(len(body)) - 1, 413},
+	} {
+		s.SetMaxBodyBytes(test.max)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", body))
+		if w.Status != test.status {
+			t.Errorf("Status with a %d bytes limit was %d, should be %d.", test.max, w.Status, test.status)
+		}
+	}
+}
+
+func TestEnableCompression(t *testing.T) {
+	s := newMockJSONServer()
+	s.EnableCompression(true)
+
+	serve := func(method, acceptEncoding string) *httptest.ResponseRecorder {
+		r := newMockJSONRequest(method, `{"A":2,"B":5}`)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	gunzip := func(w *httptest.ResponseRecorder) string {
+		if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+			t.Fatalf("Content-Encoding was %q, should be gzip.", enc)
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	w := serve("Service1.multiply", "deflate, gzip")
+	if body := gunzip(w); body != `{"Result":10}`+"\n" {
+		t.Errorf("Response body was %q, should be the product.", body)
+	}
+	if w.Header().Get("x-content-type-options") != "nosniff" {
+		t.Error("The nosniff header should be set.")
+	}
+	if w := serve("Service3.err", "gzip"); w.Code != 504 || gunzip(w) != context.DeadlineExceeded.Error() {
+		t.Errorf("Error response was %d, should be a compressed 504.", w.Code)
+	}
+	if w := serve("Service1.multiply", ""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"Result":10}`+"\n" {
+		t.Errorf("Response was %q, should not be compressed.", w.Body)
+	}
+
+	// Responses already encoded upstream are not compressed again.
+	r := newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Encoding", "br")
+	s.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "br" || w.Body.String() != `{"Result":10}`+"\n" {
+		t.Errorf("Response was %q, should not be compressed again.", w.Body)
+	}
+}
+
+func TestGzipRequest(t *testing.T) {
+	s := newMockJSONServer()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"A":2,"B":5}`))
+	zw.Close()
+	gzipped := buf.Bytes()
+
+	serve := func(body []byte) *MockResponseWriter {
+		r := newMockJSONRequest("Service1.multiply", string(body))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve(gzipped); w.Status != 200 || w.Body != `{"Result":10}`+"\n" {
+		t.Errorf("Response was %d %q, should be the product.", w.Status, w.Body)
+	}
+	if w := serve([]byte(`{"A":2,"B":5}`)); w.Status != 400 {
+		t.Errorf("Status of a body that isn't gzip was %d, should be 400.", w.Status)
+	}
+	if w := serve(gzipped[:len(gzipped)/2]); w.Status != 400 {
+		t.Errorf("Status of a truncated gzip body was %d, should be 400.", w.Status)
+	}
+	// An empty body is decoded as when it isn't encoded.
+	plain := NewMockResponseWriter()
+	s.ServeHTTP(plain, newMockJSONRequest("Service1.multiply", ""))
+	if w := serve(nil); w.Status != plain.Status || w.Body != plain.Body {
+		t.Errorf("Response to an empty body was %d %q, should be %d %q.", w.Status, w.Body, plain.Status, plain.Body)
+	}
+
+	// The limit applies to the decompressed body, shorter here.
+	s.SetMaxBodyBytes(20)
+	if w := serve(gzipped); w.Status != 200 {
+		t.Errorf("Status under the limit once decompressed was %d, should be 200.", w.Status)
+	}
+	s.SetMaxBodyBytes(10)
+	if w := serve(gzipped); w.Status != 413 {
+		t.Errorf("Status over the limit once decompressed was %d, should be 413.", w.Status)
+	}
+}
+
+func TestRegisterAfterFunc(t *testing.T) {
+	s := newMockJSONServer()
+	var infos []RequestInfo
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		infos = append(infos, *i)
+	})
+
+	serve := func(r *http.Request) RequestInfo {
+		infos = nil
+		s.ServeHTTP(httptest.NewRecorder(), r)
+		if len(infos) != 1 {
+			t.Fatalf("The after func was called %d times, should be called once.", len(infos))
+		}
+		return infos[0]
+	}
+
+	if info := serve(newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)); info.StatusCode != 200 || info.Error != nil || info.Method != "Service1.multiply" {
+		t.Errorf("Success info was %+v, should have a 200 and no error.", info)
+	}
+	if info := serve(newMockJSONRequest("Service1.multiply", `{"A":`)); info.StatusCode != 400 || info.Error == nil {
+		t.Errorf("Decode failure info was %+v, should have a 400 and the error.", info)
+	}
+	r := newMockJSONRequest("Service1.multiply", `{}`)
+	r.Header.Set("Content-Type", "text/plain")
+	if info := serve(r); info.StatusCode != 415 || info.Error == nil {
+		t.Errorf("Bad content type info was %+v, should have a 415 and the error.", info)
+	}
+	r = newMockJSONRequest("Service1.multiply", `{}`)
+	r.Method = "PUT"
+	if info := serve(r); info.StatusCode != 405 || info.Error == nil {
+		t.Errorf("Bad HTTP method info was %+v, should have a 405 and the error.", info)
+	}
+}
+
+func TestSetRequestIDHeader(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetRequestIDHeader("X-Request-ID")
+	s.SetRequestIDFunc(func() string { return "generated-1" })
+	var requestInfoID, instrumentInfoID string
+	s.RegisterInterruptFunc(func(i *RequestInfo) *InterruptInfo {
+		requestInfoID = i.RequestID
+		return nil
+	})
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		instrumentInfoID = i.RequestID
+	})
+
+	for _, test := range []struct {
+		value, id string
+	}{
+		{"req-1", "req-1"},
+		{"", "generated-1"},
+	} {
+		r := newMockJSONRequest("Service3.context", `{}`)
+		if test.value != "" {
+			r.Header.Set("X-Request-ID", test.value)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != test.id {
+			t.Errorf("Request id in the context was %q, should be %q.", w.Body, test.id)
+		}
+		if got := w.Header().Get("X-Request-ID"); got != test.id {
+			t.Errorf("Response header was %q, should be %q.", got, test.id)
+		}
+		if requestInfoID != test.id || instrumentInfoID != test.id {
+			t.Errorf("Request ids in the infos were %q and %q, should be %q.", requestInfoID, instrumentInfoID, test.id)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newMockJSONServer()
+	started, release := make(chan bool), make(chan bool)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		started <- true
+		<-release
+		res.Result = req.A * req.B
+		return nil
+	})
+
+	slow := NewMockResponseWriter()
+	served := make(chan bool)
+	go func() {
+		s.ServeHTTP(slow, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+		close(served)
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	// Wait until the server rejects new requests.
+	for {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.context", `{}`))
+		if w.Code == 503 {
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("The Retry-After header should be set during shutdown.")
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the request completed.", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v, should return nil.", err)
+	}
+	<-served
+	if slow.Status != 200 || slow.Body != `{"Result":10}`+"\n" {
+		t.Errorf("Response was %d %q, should be 200 with the product.", slow.Status, slow.Body)
+	}
+}
+
+func TestSetMaxConcurrent(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetMaxConcurrent(2)
+	started, release := make(chan bool), make(chan bool)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		if req.A < 0 {
+			panic("rpc test: panicking method")
+		}
+		started <- true
+		<-release
+		res.Result = req.A * req.B
+		return nil
+	})
+	serve := func() *MockResponseWriter {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+		return w
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serve(); w.Status != 200 {
+				t.Errorf("Status under the limit was %d, should be 200.", w.Status)
+			}
+		}()
+		<-started
+	}
+	for i := 0; i < 3; i++ {
+		if w := serve(); w.Status != 503 {
+			t.Errorf("Status over the limit was %d, should be 503.", w.Status)
+		}
+	}
+
+	// With a wait, the request gets the slot freed in the meantime.
+	s.SetMaxConcurrentWait(time.Second)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if w := serve(); w.Status != 200 {
+			t.Errorf("Status after waiting was %d, should be 200.", w.Status)
+		}
+	}()
+	release <- true
+	<-started
+	close(release)
+	wg.Wait()
+
+	// Slots are released by panicking methods.
+	s.SetMaxConcurrentWait(0)
+	for i := 0; i < 3; i++ {
+		func() {
+			defer func() { recover() }()
+			s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":-1,"B":5}`))
+		}()
+	}
+	go func() { <-started }()
+	if w := serve(); w.Status != 200 {
+		t.Errorf("Status after panics was %d, should be 200.", w.Status)
+	}
+}
+
+// PositiveRequest rejects negative numbers.
+type PositiveRequest Service1Request
+
+func (req PositiveRequest) Validate() error {
+	if req.A < 0 || req.B < 0 {
+		return errors.New("negative number")
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	s := newMockJSONServer()
+	called := false
+	err := s.RegisterFunc("Positive.multiply", func(r *http.Request, req *PositiveRequest, res *Service1Response) error {
+		called = true
+		res.Result = req.A * req.B
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Positive.multiply", `{"A":2,"B":5}`))
+	if w.Status != 200 || w.Body != `{"Result":10}`+"\n" {
+		t.Errorf("Response was %d %q, should be 200 with the product.", w.Status, w.Body)
+	}
+	called = false
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Positive.multiply", `{"A":-2,"B":5}`))
+	if w.Status != 400 || w.Body != "negative number" {
+		t.Errorf("Response was %d %q, should be 400 with the validation error.", w.Status, w.Body)
+	}
+	if called {
+		t.Error("The method should not be called with invalid args.")
+	}
+}
+
+func TestMethodWithoutRequest(t *testing.T) {
+	s := newMockJSONServer()
+	if err := s.RegisterFunc("Math.add", func(req *Service1Request, res *Service1Response) error {
+		res.Result = req.A + req.B
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method, resp string
+	}{
+		{"Service1.add", `{"Result":7}`},
+		{"Service1.multiply", `{"Result":10}`},
+		{"Math.add", `{"Result":7}`},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, `{"A":2,"B":5}`))
+		if w.Status != 200 || w.Body != test.resp+"\n" {
+			t.Errorf("%s: response was %d %q, should be 200 %q.", test.method, w.Status, w.Body, test.resp)
+		}
+	}
+	var res Service1Response
+	if err := (&Service1{}).Add(&Service1Request{2, 5}, &res); err != nil || res.Result != 7 {
+		t.Errorf("Add returned %v %v, should return 7 <nil>.", res.Result, err)
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetMethodSuccessStatus(map[string]int{"Service1.multiply": 202})
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		if req.A > 0 {
+			SetStatus(r.Context(), 201)
+		}
+		res.Result = req.A * req.B
+		return nil
+	})
+	var instrumentStatus int
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		instrumentStatus = i.StatusCode
+	})
+
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{`{"A":2,"B":5}`, 201},
+		{`{"A":0,"B":5}`, 202},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", test.body))
+		if w.Status != test.status || instrumentStatus != test.status {
+			t.Errorf("Status was %d, instrumented as %d, should be %d.", w.Status, instrumentStatus, test.status)
+		}
+	}
+}
+
+func TestRegisterCodecTypes(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{1, 1}, "application/json-rpc")
+	codec := MockCodec{2, 3}
+	s.RegisterCodecTypes(codec, "application/JSON", "Application/Json-RPC")
+
+	for _, contentType := range []string{"application/json", "application/json-rpc"} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("Content-Type", contentType)
+		if got, found := s.codecFor(r); found != codec {
+			t.Errorf("%s: codec was %v for %q, should be %v.", contentType, found, got, codec)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != 200 || w.Body != "6" {
+			t.Errorf("%s: response was %d %q, should be 200 \"6\".", contentType, w.Status, w.Body)
+		}
+	}
+}
+
+// MockTypedJSONCodec is a MockJSONCodec responding with its own Content-Type.
+type MockTypedJSONCodec struct {
+	MockJSONCodec
+}
+
+func (MockTypedJSONCodec) ContentType() string {
+	return "application/vnd.mock+json"
+}
+
+func TestRegisterCodecWithContentType(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterCodecWithContentType(MockJSONCodec{}, "application/json-rpc", "application/json-rpc; charset=utf-8")
+	s.RegisterCodec(MockTypedJSONCodec{}, "application/vnd.mock+json")
+
+	serve := func(contentType string) *httptest.ResponseRecorder {
+		r := newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	for _, test := range []struct {
+		requestType, responseType string
+	}{
+		{"application/json", "application/json"},
+		{"application/json-rpc", "application/json-rpc; charset=utf-8"},
+		{"application/vnd.mock+json", "application/vnd.mock+json"},
+	} {
+		w := serve(test.requestType)
+		if got := w.Header().Get("Content-Type"); w.Code != 200 || got != test.responseType {
+			t.Errorf("%s: response was %d with Content-Type %q, should be 200 with %q.", test.requestType, w.Code, got, test.responseType)
+		}
+	}
+
+	// The last registration wins.
+	s.RegisterCodec(MockJSONCodec{}, "application/json-rpc")
+	if got := serve("application/json-rpc").Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type was %q, should be the one of the codec.", got)
+	}
+	s.RegisterCodecWithContentType(MockJSONCodec{}, "application/json", "text/json")
+	if got := serve("application/json").Header().Get("Content-Type"); got != "text/json" {
+		t.Errorf("Content-Type was %q, should be overridden.", got)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	s := newMockJSONServer()
+	if p50, p95, p99 := s.LatencyStats("Service1.multiply"); p50 != 0 || p95 != 0 || p99 != 0 {
+		t.Errorf("Percentiles were %v %v %v while disabled, should be zeros.", p50, p95, p99)
+	}
+	s.EnableLatencyStats()
+	for i := 0; i < 20; i++ {
+		s.ServeHTTP(httptest.NewRecorder(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	}
+	p50, p95, p99 := s.LatencyStats("Service1.multiply")
+	if p50 <= 0 || p50 > p95 || p95 > p99 {
+		t.Errorf("Percentiles were %v %v %v, should be positive and ordered.", p50, p95, p99)
+	}
+	s.ServeHTTP(httptest.NewRecorder(), newMockJSONRequest("Service1.bogus", `{"A":2,"B":5}`))
+	if p50, _, _ := s.LatencyStats("Service1.bogus"); p50 != 0 {
+		t.Errorf("Unknown methods shouldn't be recorded, got %v.", p50)
+	}
+	s.ResetLatencyStats()
+	if p50, _, _ := s.LatencyStats("Service1.multiply"); p50 != 0 {
+		t.Errorf("Percentiles should be reset, got %v.", p50)
+	}
+
+	// Only the latest durations are kept.
+	for i := 1; i <= latencyReservoirSize+100; i++ {
+		d := time.Hour
+		if i > 100 {
+			d = time.Duration(i-100) * time.Millisecond
+		}
+		s.latency.observe("Service1.multiply", d)
+	}
+	p50, p95, p99 = s.LatencyStats("Service1.multiply")
+	if p50 != 512*time.Millisecond || p95 != 973*time.Millisecond || p99 != 1014*time.Millisecond {
+		t.Errorf("Percentiles were %v %v %v, should be 512ms 973ms 1.014s.", p50, p95, p99)
+	}
+}
+
+func TestSetServiceCodec(t *testing.T) {
+	s := newMockJSONServer()
+	serve := func(method, contentType string) *httptest.ResponseRecorder {
+		r := newMockJSONRequest(method, `{"A":2,"B":5}`)
+		r.Header.Del("Content-Type")
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve("Service1.multiply", ""); w.Code != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Without overrides the single codec should be used, got %d %q.", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	s.RegisterService(new(Service1), "Other")
+	s.RegisterCodec(MockTypedJSONCodec{}, "application/vnd.mock+json")
+	s.SetServiceCodec("Service1", "application/vnd.mock+json")
+	for _, test := range []struct {
+		method, requestType string
+		status              int
+		responseType        string
+	}{
+		{"Service1.multiply", "", 200, "application/vnd.mock+json"},
+		{"Service1.multiply", "application/json", 200, "application/json"},
+		{"Other.multiply", "", 415, "text/plain; charset=utf-8"},
+		{"Other.multiply", "application/json", 200, "application/json"},
+	} {
+		w := serve(test.method, test.requestType)
+		if w.Code != test.status || w.Header().Get("Content-Type") != test.responseType {
+			t.Errorf("%s with %q: response was %d %q, should be %d %q.", test.method, test.requestType,
+				w.Code, w.Header().Get("Content-Type"), test.status, test.responseType)
+		}
+		if test.status == 200 && strings.TrimSpace(w.Body.String()) != `{"Result":10}` {
+			t.Errorf("%s with %q: body was %q, should be the reply.", test.method, test.requestType, w.Body)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	s := newMockJSONServer()
+	h := s.HealthHandler()
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", HealthPath, nil))
+		return w
+	}
+	if w := serve(); w.Code != 200 || w.Body.String() != `{"status":"ok","services":2}`+"\n" {
+		t.Errorf("Response without checks was %d %q, should be 200 and ok.", w.Code, w.Body)
+	}
+
+	var errDB error
+	s.AddReadinessCheck("db", func() error { return errDB })
+	if w := serve(); w.Code != 200 {
+		t.Errorf("Response with passing checks was %d, should be 200.", w.Code)
+	}
+	errDB = errors.New("connection refused")
+	want := `{"status":"unavailable","services":2,"failures":{"db":"connection refused"}}` + "\n"
+	if w := serve(); w.Code != 503 || w.Body.String() != want {
+		t.Errorf("Response with a failing check was %d %q, should be 503 %q.", w.Code, w.Body, want)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", HealthPath, nil))
+	if w.Code != 405 {
+		t.Errorf("POST response was %d, should be 405.", w.Code)
+	}
+}
+
+// MockLogger records the messages logged.
+type MockLogger struct {
+	entries []string
+}
+
+func (l *MockLogger) Printf(format string, v ...interface{}) {
+	l.entries = append(l.entries, fmt.Sprintf(format, v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	s := newMockJSONServer()
+	logger := &MockLogger{}
+	s.SetLogger(logger)
+
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if len(logger.entries) != 0 {
+		t.Errorf("Entries were %q, should be none for a success.", logger.entries)
+	}
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.unknown", `{}`))
+	want := `rpc: POST "Service1.unknown" failed with status 404: rpc: unknown method "unknown" on service "Service1"`
+	if len(logger.entries) != 1 || logger.entries[0] != want {
+		t.Errorf("Entries were %q, should be [%q].", logger.entries, want)
+	}
+	r := newMockJSONRequest("Service1.multiply", `{}`)
+	r.Method = "PUT"
+	s.ServeHTTP(NewMockResponseWriter(), r)
+	if len(logger.entries) != 2 || !strings.Contains(logger.entries[1], "status 405") {
+		t.Errorf("Entries were %q, should end with the 405.", logger.entries)
+	}
+}
+
+func TestRequestInfoFromContext(t *testing.T) {
+	s := newMockJSONServer()
+	var handlerInfo, afterInfo *RequestInfo
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		info, ok := RequestInfoFromContext(r.Context())
+		if !ok || info.Method != "Service1.multiply" {
+			t.Errorf("Info was %+v, should have the method.", info)
+		}
+		handlerInfo = info
+		SetStatus(r.Context(), 201)
+		return nil
+	})
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		afterInfo = i
+	})
+
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	if handlerInfo == nil || afterInfo != handlerInfo || afterInfo.StatusCode != 201 {
+		t.Errorf("After func info was %+v, should be the handler one with a 201.", afterInfo)
+	}
+	if _, ok := RequestInfoFromContext(context.Background()); ok {
+		t.Error("There should be no info outside of a request.")
+	}
+}
+
+func TestStreamInterfaceValues(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "application/json")
+	err := s.RegisterFunc("Items.list", func(r *http.Request, req *struct{}, res chan<- interface{}) error {
+		for _, item := range []interface{}{1, "two", Service1Response{3}} {
+			select {
+			case res <- item:
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Items.list", ``))
+	if want := `{"result":[1,"two",{"Result":3}],"error":null}`; w.Status != 200 || w.Body != want {
+		t.Errorf("Response was %d %s, should be 200 %s.", w.Status, w.Body, want)
+	}
+	if w.Flushes < 3 {
+		t.Errorf("Response was flushed %d times, should be at least 3.", w.Flushes)
+	}
+}
+
+func TestSetFallbackHandler(t *testing.T) {
+	s := newMockJSONServer()
+	var fallbackMethod string
+	s.SetFallbackHandler(func(w http.ResponseWriter, r *http.Request, method string) {
+		fallbackMethod = method
+		codecReq, ok := CodecRequestFromContext(r.Context())
+		if !ok {
+			t.Fatal("The codec request should be in the context.")
+		}
+		var args Service1Request
+		if err := codecReq.ReadRequest(&args); err != nil {
+			codecReq.WriteError(w, 400, err, nil)
+			return
+		}
+		w.WriteHeader(202)
+		codecReq.WriteResponse(w, &Service1Response{args.A - args.B})
+	})
+	var instrumentStatus int
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		instrumentStatus = i.StatusCode
+	})
+
+	for _, test := range []struct {
+		method, fallback string
+		status           int
+		body             string
+	}{
+		{"Upstream.subtract", "Upstream.subtract", 202, `{"Result":-3}` + "\n"},
+		{"Service1.subtract", "Service1.subtract", 202, `{"Result":-3}` + "\n"},
+		{"Service1.multiply", "", 200, `{"Result":10}` + "\n"},
+		{"Service1", "", 400, `rpc: service/method request ill-formed: "Service1"`},
+	} {
+		fallbackMethod = ""
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, `{"A":2,"B":5}`))
+		if w.Status != test.status || w.Body != test.body || instrumentStatus != test.status {
+			t.Errorf("%s: response was %d %q, should be %d %q.", test.method, w.Status, w.Body, test.status, test.body)
+		}
+		if fallbackMethod != test.fallback {
+			t.Errorf("%s: fallback got %q, should get %q.", test.method, fallbackMethod, test.fallback)
+		}
+	}
+}
+
+func TestSetNotFoundHandler(t *testing.T) {
+	s := newMockJSONServer()
+	s.SetNotFoundHandler(func(w http.ResponseWriter, r *http.Request, method string) {
+		if _, ok := CodecRequestFromContext(r.Context()); !ok {
+			t.Error("The codec request should be in the context.")
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		fmt.Fprintf(w, `{"type":"not-found","method":%q}`, method)
+	})
+
+	for _, test := range []struct {
+		method string
+		status int
+		body   string
+	}{
+		{"Service1.subtract", 404, `{"type":"not-found","method":"Service1.subtract"}`},
+		{"Upstream.subtract", 404, `{"type":"not-found","method":"Upstream.subtract"}`},
+		{"Service1.multiply", 200, `{"Result":10}` + "\n"},
+		{"Service1", 400, `rpc: service/method request ill-formed: "Service1"`},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, `{"A":2,"B":5}`))
+		if w.Status != test.status || w.Body != test.body {
+			t.Errorf("%s: response was %d %q, should be %d %q.", test.method, w.Status, w.Body, test.status, test.body)
+		}
+	}
+
+	s.SetFallbackHandler(func(w http.ResponseWriter, r *http.Request, method string) {
+		w.WriteHeader(202)
+	})
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, newMockJSONRequest("Upstream.subtract", `{"A":2,"B":5}`))
+	if w.Status != 202 {
+		t.Errorf("The fallback handler should take precedence, status was %d.", w.Status)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	s := newMockJSONServer()
+	s.EnableMetrics()
+	h := s.MetricsHandler()
+
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`))
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.multiply", `{"A":`))
+	s.ServeHTTP(NewMockResponseWriter(), newMockJSONRequest("Service1.random123", `{}`))
+	// Requests rejected before reading the method are recorded too.
+	r := newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)
+	r.Header.Set("Content-Type", "text/plain")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+	s.ServeHTTP(NewMockResponseWriter(), httptest.NewRequest("PUT", "/", nil))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`rpc_requests_total{method="Service1.multiply",status="200"} 2`,
+		`rpc_requests_total{method="Service1.multiply",status="400"} 1`,
+		`rpc_errors_total{method="Service1.multiply",status="200"} 0`,
+		`rpc_errors_total{method="Service1.multiply",status="400"} 1`,
+		`rpc_requests_total{method="unknown",status="404"} 1`,
+		`rpc_requests_total{method="unknown",status="405"} 1`,
+		`rpc_requests_total{method="unknown",status="415"} 1`,
+		`rpc_errors_total{method="unknown",status="415"} 1`,
+		`rpc_request_duration_seconds_bucket{method="Service1.multiply",status="200",le="+Inf"} 2`,
+		`rpc_request_duration_seconds_count{method="Service1.multiply",status="200"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics should contain %s, got:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "random123") {
+		t.Error("Unknown methods should not get their own label.")
+	}
+}
+
+// MockCreatedCodec is a MockJSONCodec writing its own 201 status.
+type MockCreatedCodec struct {
+	MockJSONCodec
+}
+
+func (c MockCreatedCodec) NewRequest(r *http.Request) CodecRequest {
+	return mockCreatedRequest{&MockJSONCodecRequest{codec: c.MockJSONCodec, r: r}}
+}
+
+type mockCreatedRequest struct {
+	*MockJSONCodecRequest
+}
+
+func (c mockCreatedRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	w.WriteHeader(201)
+	c.MockJSONCodecRequest.WriteResponse(w, reply)
+}
+
+func TestSetSuccessStatus(t *testing.T) {
+	s := newMockJSONServer()
+	s.RegisterCodec(MockCreatedCodec{}, "application/created+json")
+	s.SetSuccessStatus(202)
+	s.SetMethodSuccessStatus(map[string]int{"Service3.product": 201})
+	var instrumentStatus int
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		instrumentStatus = i.StatusCode
+	})
+
+	for _, test := range []struct {
+		method string
+		status int
+	}{
+		{"Service1.multiply", 202},
+		{"Service3.product", 201},
+		{"Service3.err", 504},
+	} {
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, newMockJSONRequest(test.method, `{"A":2,"B":5}`))
+		if w.Status != test.status || instrumentStatus != test.status {
+			t.Errorf("%s: status was %d, instrumented as %d, should be %d.", test.method, w.Status, instrumentStatus, test.status)
+		}
+	}
+
+	// Codecs writing their own status keep it.
+	r := newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)
+	r.Header.Set("Content-Type", "application/created+json")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 201 || w.Body != `{"Result":10}`+"\n" || instrumentStatus != 201 {
+		t.Errorf("Response was %d %q, should be the 201 of the codec.", w.Status, w.Body)
+	}
+}
+
+func TestEnablePooling(t *testing.T) {
+	s := newMockJSONServer()
+	s.EnablePooling(true)
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		if res.Result != 0 {
+			return errors.New("reply not zeroed")
+		}
+		res.Result = req.A * req.B
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// Args missing B must not see the B of other requests.
+				body := fmt.Sprintf(`{"A":%d,"B":2}`, i)
+				if j%2 == 1 {
+					body = fmt.Sprintf(`{"A":%d}`, i)
+				}
+				w := NewMockResponseWriter()
+				s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", body))
+				want := fmt.Sprintf(`{"Result":%d}`+"\n", i*2*(1-j%2))
+				if w.Status != 200 || w.Body != want {
+					t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, want)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkPooling(b *testing.B) {
+	for name, enabled := range map[string]bool{"reflect": false, "pooling": true} {
+		b.Run(name, func(b *testing.B) {
+			s := NewServer()
+			s.RegisterCodec(MockCodec{2, 5}, "mock")
+			s.RegisterService(new(Service1), "")
+			s.EnablePooling(enabled)
+			r, _ := http.NewRequest("POST", "", nil)
+			r.Header.Set("Content-Type", "mock")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.ServeHTTP(NewMockResponseWriter(), r)
+			}
+		})
+	}
+}
+
+func TestInstrumentContentType(t *testing.T) {
+	s := newMockJSONServer()
+	var info *InstrumentInfo
+	s.RegisterInstrumentFunc(func(i *InstrumentInfo) {
+		info = i
+	})
+
+	serve := func(contentType, accept string) {
+		r := newMockJSONRequest("Service1.multiply", `{"A":2,"B":5}`)
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Accept", accept)
+		s.ServeHTTP(NewMockResponseWriter(), r)
+	}
+	// The single codec serves requests without Content-Type.
+	serve("", "")
+	if info.ContentType != "application/json" || info.ResponseType != "" {
+		t.Errorf("Types were %q %q, should be the single codec one.", info.ContentType, info.ResponseType)
+	}
+
+	s.RegisterCodec(MockTextCodec{MockCodec{2, 5}}, "text/plain")
+	for _, test := range []struct {
+		contentType, accept, matched, response string
+	}{
+		{"application/JSON; charset=utf-8", "", "application/json", ""},
+		{"application/json", "text/plain", "application/json", "text/plain"},
+		{"text/plain", "", "text/plain", ""},
+	} {
+		serve(test.contentType, test.accept)
+		if info.ContentType != test.matched || info.ResponseType != test.response {
+			t.Errorf("%s: types were %q %q, should be %q %q.", test.contentType, info.ContentType, info.ResponseType, test.matched, test.response)
+		}
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	s := newMockJSONServer()
+	s.ReplaceMethod("Service1.multiply", func(r *http.Request, req *Service1Request, res *Service1Response) error {
+		h := ResponseHeader(r.Context())
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("X-Content-Type-Options", "sniff")
+		if req.B == 0 {
+			return errors.New("no B")
+		}
+		res.Result = req.A * req.B
+		return nil
+	})
+
+	for _, body := range []string{`{"A":2,"B":5}`, `{"A":2}`} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, newMockJSONRequest("Service1.multiply", body))
+		if got := w.Header().Get("Cache-Control"); got != "max-age=60" {
+			t.Errorf("%s: Cache-Control was %q, should be set by the method.", body, got)
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: X-Content-Type-Options was %q, should be kept.", body, got)
+		}
+	}
+	if h := ResponseHeader(context.Background()); h == nil {
+		t.Error("The header outside of a method call should be usable.")
+	}
+}
+
+func TestRegisterServiceFiltered(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterServiceFiltered(new(Service1), "", func(methodName string) bool {
+		return methodName == "Multiply"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Service1.multiply") || s.HasMethod("Service1.add") {
+		t.Error("Only Service1.multiply should be registered.")
+	}
+
+	err = s.RegisterServiceFiltered(new(Service1), "Service2", func(string) bool { return false })
+	if err == nil || err.Error() != `rpc: "Service2" has no exported methods of suitable type` {
+		t.Errorf("Error was %v, should be the no methods one.", err)
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("Service%d", 100+i)
+			if err := s.RegisterService(new(Service1), name); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := s.UnregisterService(name); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != 200 || w.Body != "6" {
+			t.Fatalf("Response was %d %q, should be 200 \"6\".", w.Status, w.Body)
+		}
+		s.HasMethod(fmt.Sprintf("Service%d.multiply", 100+i))
+	}
+	<-done
+}
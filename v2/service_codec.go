@@ -0,0 +1,76 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SetServiceCodec makes the requests without a Content-Type header for the
+// methods of the named service use the codec registered for contentType,
+// rather than the codec used by default when only one is registered. An
+// empty contentType removes the override.
+//
+// The service of such requests is found by buffering their body and reading
+// their method with the codecs of the overrides in turn: the first one
+// reading a method of a service it is set for is used. Requests for other
+// services, or whose method none of them can read, are served as without
+// overrides.
+func (s *Server) SetServiceCodec(serviceName string, contentType string) {
+	if contentType == "" {
+		delete(s.serviceCodecs, serviceName)
+	} else {
+		if s.serviceCodecs == nil {
+			s.serviceCodecs = make(map[string]string)
+		}
+		s.serviceCodecs[serviceName] = strings.ToLower(contentType)
+	}
+	seen := make(map[string]bool)
+	s.serviceCodecTypes = s.serviceCodecTypes[:0]
+	for _, t := range s.serviceCodecs {
+		if !seen[t] {
+			seen[t] = true
+			s.serviceCodecTypes = append(s.serviceCodecTypes, t)
+		}
+	}
+	sort.Strings(s.serviceCodecTypes)
+}
+
+// serviceCodecFor returns the request with its body buffered, and the codec
+// set with SetServiceCodec for its service and its content type, or a nil
+// codec if there is none. It returns the status code and error to reject the
+// request with if its body can't be read.
+func (s *Server) serviceCodecFor(r *http.Request) (*http.Request, string, Codec, int, error) {
+	r, body, err := bufferBody(r)
+	if err != nil {
+		return r, "", nil, readErrorStatus(r, err), err
+	}
+	for _, contentType := range s.serviceCodecTypes {
+		codec := s.codecs[contentType]
+		if codec == nil || (s.allowedTypes != nil && !s.allowedTypes[contentType]) {
+			continue
+		}
+		cr := new(http.Request)
+		*cr = *r
+		cr.Body = io.NopCloser(bytes.NewReader(body))
+		method, err := codec.NewRequest(cr).Method()
+		if err != nil {
+			continue
+		}
+		if s.methodPrefix != "" {
+			method = strings.TrimPrefix(method, s.methodPrefix)
+		}
+		service, _, _ := strings.Cut(s.services.canonical(method), ".")
+		if s.serviceCodecs[service] == contentType {
+			return r, contentType, codec, 200, nil
+		}
+	}
+	return r, "", nil, 200, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// shutdownRetryAfter is the Retry-After header, in seconds, of the requests
+// rejected during shutdown.
+const shutdownRetryAfter = "1"
+
+// drain tracks the requests in flight, for Shutdown.
+type drain struct {
+	mu           sync.RWMutex
+	shuttingDown bool
+	active       sync.WaitGroup
+}
+
+// enter registers a request, returning false if the server is shutting down.
+func (d *drain) enter() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.shuttingDown {
+		return false
+	}
+	d.active.Add(1)
+	return true
+}
+
+// Shutdown makes the server reject new requests with a 503 and waits for the
+// requests in flight to complete, or for ctx to be done, in which case it
+// returns the context error. The server can't be restarted.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drain.mu.Lock()
+	s.drain.shuttingDown = true
+	s.drain.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.drain.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// errShuttingDown is the error of the requests rejected during shutdown.
+var errShuttingDown = errors.New("rpc: server is shutting down")
+
+// rejectShutdown writes the response of a request rejected during shutdown.
+func rejectShutdown(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", shutdownRetryAfter)
+	WriteError(w, http.StatusServiceUnavailable, errShuttingDown.Error())
+}
@@ -0,0 +1,80 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+)
+
+// SetSuccessStatus sets the status code sent instead of 200 when methods
+// succeed, e.g. 202 for gateways accepting calls to complete them later. It
+// is overridden by SetMethodSuccessStatus and SetStatus, and codecs writing a
+// status other than 200 keep it. The status of the errors depends on them;
+// see Error.
+func (s *Server) SetSuccessStatus(status int) {
+	s.successStatus = status
+}
+
+// SetMethodSuccessStatus sets the status codes sent instead of 200 when the
+// methods succeed, e.g. {"Users.Create": 201, "Users.Delete": 204}. The
+// reply is not written for 204. The methods use a dotted notation as in
+// "Service.Method" and streaming methods are not affected.
+func (s *Server) SetMethodSuccessStatus(statuses map[string]int) {
+	s.successStatuses = make(map[string]int, len(statuses))
+	for method, status := range statuses {
+		s.successStatuses[s.services.canonical(method)] = status
+	}
+}
+
+// SetStatus sets the status code sent instead of 200 when the method called
+// with ctx succeeds, e.g. 201, overriding SetMethodSuccessStatus. The reply
+// is not written for 204. It has no effect on streaming methods.
+func SetStatus(ctx context.Context, status int) {
+	if successStatus, ok := ctx.Value(successStatusKey).(*int); ok {
+		*successStatus = status
+	}
+}
+
+// successStatusFor returns the status code of a successful call of method
+// given the one set with SetStatus, or 0 for a 200.
+func (s *Server) successStatusFor(method string, status int) int {
+	if status == 0 {
+		status = s.successStatuses[method]
+	}
+	if status == 0 {
+		status = s.successStatus
+	}
+	return status
+}
+
+// statusWriter replaces the 200 status written by a codec, recording the
+// status written.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if status == 200 {
+		status = w.status
+	}
+	if !w.wroteHeader {
+		w.written = status
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	// Codecs may write the body without a status.
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(p)
+}
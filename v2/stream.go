@@ -0,0 +1,154 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// StreamErrorTrailer is the HTTP trailer holding the message of the error
+// that interrupted a stream once started, for clients not reading the error
+// framed by the codec.
+const StreamErrorTrailer = "Rpc-Stream-Error"
+
+// serveStream calls a streaming method and encodes the values it sends as
+// they arrive. It returns the status code and the error of the method.
+//
+// The channel is unbuffered and the response is flushed after each value, so
+// a method sending faster than the client reads is held back by the writer.
+// The channel is closed by the server once the method returns; methods must
+// not close it themselves.
+//
+// An error returned before any value was sent is written using the codec
+// error path as for regular methods. Once the stream has started the status
+// is already sent, so the error is passed to WriteStreamEnd instead, and
+// set in the StreamErrorTrailer trailer.
+//
+// If the client goes away or the stream can't be written, the request
+// context seen by the method is cancelled and the remaining values are
+// discarded until the method returns.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, serviceSpec *service, methodSpec *serviceMethod, args reflect.Value) (int, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	ch := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, methodSpec.replyType), 0)
+	errc := make(chan error, 1)
+	go func() {
+		defer ch.Close()
+		defer func() {
+			if p := recover(); p != nil {
+				errc <- fmt.Errorf("rpc: panic serving %s: %v", methodSpec.method.Name, p)
+			}
+		}()
+		s.withPprofLabels(r.WithContext(ctx), MethodFromContext(r.Context()), func(r *http.Request) {
+			errc <- methodSpec.call(serviceSpec.rcvr, reflect.ValueOf(r), args, ch)
+		})
+	}()
+	// stop cancels the method and discards whatever it still sends, so it
+	// isn't left blocked on the channel.
+	stop := func() {
+		cancel()
+		go func() {
+			for {
+				if _, ok := ch.Recv(); !ok {
+					return
+				}
+			}
+		}()
+	}
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	// recv returns the next value, or false once the channel is closed or
+	// the client has gone away.
+	recv := func() (reflect.Value, bool) {
+		chosen, v, ok := reflect.Select(cases)
+		return v, chosen == 0 && ok
+	}
+
+	// wait returns the error of the method once it has returned.
+	var methodErr error
+	returned := false
+	wait := func() error {
+		if !returned {
+			methodErr, returned = <-errc, true
+		}
+		return methodErr
+	}
+
+	value, ok := recv()
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			stop()
+			return s.writeMethodError(w, r, codecReq, err, nil), err
+		}
+		if err := wait(); err != nil {
+			return s.writeMethodError(w, r, codecReq, err, nil), err
+		}
+	}
+	sc, streaming := codecReq.(StreamingCodecRequest)
+	if !streaming {
+		// Without streaming support the whole stream is buffered, so the
+		// error can still be written as for regular methods.
+		values := []interface{}{}
+		for ; ok; value, ok = recv() {
+			values = append(values, s.filterReply(r, value.Interface()))
+		}
+		if err := ctx.Err(); err != nil {
+			stop()
+			return s.writeMethodError(w, r, codecReq, err, nil), err
+		}
+		if err := wait(); err != nil {
+			return s.writeMethodError(w, r, codecReq, err, nil), err
+		}
+		codecReq.WriteResponse(w, values)
+		return 200, nil
+	}
+
+	flusher, _ := w.(http.Flusher)
+	err := sc.WriteStreamStart(w)
+	for ok && err == nil {
+		if err = sc.WriteStreamValue(w, s.filterReply(r, value.Interface())); err != nil {
+			break
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		value, ok = recv()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		stop()
+		// The client may still be there if only encoding failed.
+		if r.Context().Err() == nil {
+			sc.WriteStreamEnd(w, err)
+			setStreamErrorTrailer(w, err)
+		}
+		return 200, err
+	}
+	err = wait()
+	if errEnd := sc.WriteStreamEnd(w, err); err == nil {
+		err = errEnd
+	}
+	if err != nil {
+		setStreamErrorTrailer(w, err)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return 200, err
+}
+
+// setStreamErrorTrailer sets the StreamErrorTrailer trailer to the error
+// message.
+func setStreamErrorTrailer(w http.ResponseWriter, err error) {
+	w.Header().Set(http.TrailerPrefix+StreamErrorTrailer, err.Error())
+}
@@ -0,0 +1,83 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// SetRequestTimeout sets a deadline for serving whole requests, covering
+// decoding, calling the method and encoding, as a coarse safety net. The
+// request context gets the deadline, reading the body past it fails, and
+// requests going past it are answered with a 504 written by the codec.
+// Streams already started are cut off.
+//
+// Regular methods are then called on their own goroutine, so the response
+// doesn't wait for methods overrunning the deadline. Methods must still
+// honor the context for their work to actually stop; a panic is reported as
+// an error.
+//
+// Zero, the default, means no timeout.
+func (s *Server) SetRequestTimeout(d time.Duration) {
+	s.requestTimeout = d
+}
+
+// withRequestTimeout returns a copy of the request with the request timeout
+// applied, and the func releasing its context.
+func (s *Server) withRequestTimeout(r *http.Request) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	r = r.WithContext(ctx)
+	if r.Body != nil {
+		r.Body = &deadlineBody{ReadCloser: r.Body, ctx: ctx}
+	}
+	return r, cancel
+}
+
+// callWithTimeout calls a regular method on its own goroutine, returning the
+// context error once the request deadline has passed, whether the method
+// has returned or not. The method gets its own reply, copied to reply if it
+// returns in time, so it can't race with the encoding.
+func (s *Server) callWithTimeout(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	own := reflect.New(reply.Type().Elem())
+	own.Elem().Set(reply.Elem())
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("rpc: panic serving %s: %v", method, p)
+			}
+		}()
+		done <- s.callPooled(r, method, serviceSpec, methodSpec, args, own)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			err = r.Context().Err()
+		}
+		reply.Elem().Set(own.Elem())
+		return err
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+// deadlineBody fails reads once its context is done.
+type deadlineBody struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
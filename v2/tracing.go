@@ -0,0 +1,98 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer starts the spans of the requests served by a Server. It can be
+// backed by any tracing library.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, if any, and
+	// returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// RecordError records an error on the span.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// HeaderTracer is implemented by Tracers continuing the traces of the
+// clients: the span of a request is started from the context returned by
+// Extract, given the request headers.
+type HeaderTracer interface {
+	Tracer
+	Extract(ctx context.Context, header http.Header) context.Context
+}
+
+// StatusSpan is implemented by Spans recording the status code of the
+// response. SetStatus is called on the span of a request before it is ended.
+type StatusSpan interface {
+	Span
+	SetStatus(code int)
+}
+
+// SetTracer enables tracing of the requests with t.
+//
+// Each request gets a span named after the method, with child spans named
+// "decode", "handler" and "encode" for the decoding of the args, the call
+// of the method and the encoding of the response. Errors are recorded on
+// the span of the phase they occur in and on the request span. The handler
+// span covers the whole stream of streaming methods, which have no encode
+// span. Methods can start their own spans from the request context. Tracers
+// can also implement HeaderTracer and their spans StatusSpan. Builds with
+// the "otel" tag also provide SetTracerProvider, for OpenTelemetry.
+func (s *Server) SetTracer(t Tracer) {
+	s.tracer = t
+}
+
+// startSpan starts a span if tracing is enabled, returning the request with
+// the span in its context.
+func (s *Server) startSpan(r *http.Request, name string) (*http.Request, Span) {
+	if s.tracer == nil {
+		return r, noopSpan{}
+	}
+	ctx, span := s.tracer.Start(r.Context(), name)
+	return r.WithContext(ctx), span
+}
+
+// startRequestSpan starts the span of a request, continuing the trace of the
+// client if the tracer implements HeaderTracer.
+func (s *Server) startRequestSpan(r *http.Request, method string) (*http.Request, Span) {
+	if ht, ok := s.tracer.(HeaderTracer); ok {
+		r = r.WithContext(ht.Extract(r.Context(), r.Header))
+	}
+	return s.startSpan(r, method)
+}
+
+// endRequestSpan records the status code and err on the span of a request,
+// and ends it.
+func endRequestSpan(span Span, status int, err error) {
+	if ss, ok := span.(StatusSpan); ok {
+		ss.SetStatus(status)
+	}
+	endSpan(span, err)
+}
+
+// endSpan records err on the span, if not nil, and ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// noopSpan is the span used when tracing is disabled.
+type noopSpan struct{}
+
+func (noopSpan) RecordError(err error) {}
+func (noopSpan) End()                  {}